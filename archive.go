@@ -0,0 +1,255 @@
+// upl
+//
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+func downloadZip(c echo.Context, conf config) error {
+
+	st := storeStorage(conf)
+	rel, err := storageDir(st, c.FormValue("path"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+
+	params, err := c.FormParams()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	names := make([]string, 0, len(params["name"]))
+	for _, n := range params["name"] {
+		filename, err := cleanFilename(n)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+
+		// Sidecars hold the password hashes of protected files
+		if isReservedFile(filename) {
+			log.Println("skipping internal file in zip archive:", filename)
+			continue
+		}
+		names = append(names, filename)
+	}
+
+	if len(names) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "no files selected")
+	}
+
+	// The archive is streamed to the client, errors cannot be reported with
+	// a status code once the first entry is written
+	c.Response().Header().Set(echo.HeaderContentType, "application/zip")
+	c.Response().Header().Set(echo.HeaderContentDisposition, `attachment; filename="upl.zip"`)
+	c.Response().WriteHeader(http.StatusOK)
+
+	zw := zip.NewWriter(c.Response())
+	for _, name := range names {
+		if err := addZipEntry(zw, st, path.Join(rel, name), name); err != nil {
+			if os.IsNotExist(err) {
+				log.Println("skipping missing file in zip archive:", name)
+				continue
+			}
+			return err
+		}
+	}
+
+	return zw.Close()
+}
+
+// addZipEntry copies the file p of the storage into the archive under the
+// given name. Directories are skipped.
+func addZipEntry(zw *zip.Writer, st storage, p string, name string) error {
+	fe, err := st.Stat(p)
+	if err != nil {
+		return err
+	}
+
+	if fe.IsDir {
+		log.Println("skipping directory in zip archive:", name)
+		return nil
+	}
+
+	// Protected files are only downloaded with their password
+	if m, err := loadMeta(st, p); err != nil || m.PasswordHash != "" {
+		log.Println("skipping protected file in zip archive:", name)
+		return nil
+	}
+
+	f, err := st.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hdr := &zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: fe.ModTime,
+	}
+	hdr.UncompressedSize64 = uint64(fe.Size)
+	hdr.SetMode(0644)
+
+	w, err := zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// downloadTar streams a gzip compressed tar archive of the directory given by
+// the path parameter and its subdirectories. Entries hidden from the listing
+// and protected files are left out.
+func downloadTar(c echo.Context, conf config) error {
+
+	st := storeStorage(conf)
+	rel, err := storageDir(st, c.QueryParam("path"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+
+	name := path.Base(rel)
+	if rel == "" {
+		name = conf.StoreName
+		if name == "" {
+			name = "upl"
+		}
+	}
+
+	c.Response().Header().Set(echo.HeaderContentType, "application/gzip")
+	c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="%s.tar.gz"`, strings.ReplaceAll(name, `"`, "_")))
+	c.Response().WriteHeader(http.StatusOK)
+	if c.Request().Method == http.MethodHead {
+		return nil
+	}
+
+	gw, err := gzip.NewWriterLevel(c.Response(), conf.GzipLevel)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(gw)
+
+	if err := addTarDir(tw, st, rel, "", conf); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// addTarDir writes the entries of the directory p of the storage into the
+// archive, under the prefix name, recursively
+func addTarDir(tw *tar.Writer, st storage, p string, prefix string, conf config) error {
+	files, err := st.List(p)
+	if err != nil {
+		return err
+	}
+	files, withMeta := splitMetaFiles(files)
+	files = hideEntries(files, conf)
+
+	for _, f := range files {
+		name := path.Join(prefix, f.Name)
+		fp := path.Join(p, f.Name)
+
+		if f.IsDir {
+			hdr := &tar.Header{
+				Typeflag: tar.TypeDir,
+				Name:     name + "/",
+				Mode:     0755,
+				ModTime:  f.ModTime,
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			if err := addTarDir(tw, st, fp, name, conf); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// Protected files are only downloaded with their password
+		if withMeta[f.Name] {
+			if m, err := loadMeta(st, fp); err != nil || m.PasswordHash != "" {
+				log.Println("skipping protected file in tar archive:", name)
+				continue
+			}
+		}
+
+		if err := addTarEntry(tw, st, fp, name); err != nil {
+			if os.IsNotExist(err) {
+				log.Println("skipping missing file in tar archive:", name)
+				continue
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+// addTarEntry copies the file p of the storage into the archive under the
+// given name. The size in the header is the one of the file when it is
+// opened, the archive would be corrupted by a file changing meanwhile.
+func addTarEntry(tw *tar.Writer, st storage, p string, name string) error {
+	fe, err := st.Stat(p)
+	if err != nil {
+		return err
+	}
+
+	f, err := st.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0644,
+		Size:     fe.Size,
+		ModTime:  fe.ModTime,
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+
+	_, err = io.CopyN(tw, f, fe.Size)
+	return err
+}
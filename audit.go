@@ -0,0 +1,164 @@
+// upl
+//
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/labstack/echo/v4"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Number of audit entries waiting to be written, new entries are dropped
+// when the queue is full so that requests never wait for the disk
+const auditQueueLen = 1024
+
+// Actions recorded in the audit log
+const (
+	auditUpload = "upload"
+	auditDelete = "delete"
+	auditRename = "rename"
+	auditMove   = "move"
+	auditMkdir  = "mkdir"
+)
+
+// An auditEntry is a line of the audit log
+type auditEntry struct {
+	Time   string `json:"time"`
+	IP     string `json:"client_ip"`
+	Store  string `json:"store,omitempty"`
+	Action string `json:"action"`
+	// Path of the file relative to the store, its new path for renames and
+	// moves
+	Path string `json:"path"`
+	To   string `json:"to,omitempty"`
+	Size int64  `json:"size"`
+}
+
+// An auditLog appends entries to a file from a goroutine, in the order they
+// are recorded
+type auditLog struct {
+	f       *os.File
+	mu      sync.RWMutex
+	closed  bool
+	entries chan auditEntry
+	done    chan struct{}
+}
+
+// The audit log of the configuration, nil when disabled
+var auditor *auditLog
+
+// openAuditLog opens the audit log file for appending, it is created when
+// missing and never truncated
+func openAuditLog(name string) (*auditLog, error) {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &auditLog{
+		f:       f,
+		entries: make(chan auditEntry, auditQueueLen),
+		done:    make(chan struct{}),
+	}
+	go a.write()
+
+	return a, nil
+}
+
+// write writes the queued entries as JSON lines, the buffer is flushed each
+// time the queue is empty
+func (a *auditLog) write() {
+	defer close(a.done)
+
+	w := bufio.NewWriter(a.f)
+	enc := json.NewEncoder(w)
+	for e := range a.entries {
+		if err := enc.Encode(e); err != nil {
+			log.Println("could not write audit log:", err)
+		}
+		if len(a.entries) == 0 {
+			if err := w.Flush(); err != nil {
+				log.Println("could not write audit log:", err)
+			}
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		log.Println("could not write audit log:", err)
+	}
+}
+
+// record queues an entry, it is dropped when the queue is full or the log
+// is closed
+func (a *auditLog) record(e auditEntry) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if a.closed {
+		return
+	}
+
+	select {
+	case a.entries <- e:
+	default:
+		log.Printf("audit log queue is full, dropped %s of %s", e.Action, e.Path)
+	}
+}
+
+// close writes the queued entries and closes the file
+func (a *auditLog) close() error {
+	a.mu.Lock()
+	if !a.closed {
+		a.closed = true
+		close(a.entries)
+	}
+	a.mu.Unlock()
+
+	<-a.done
+	return a.f.Close()
+}
+
+// audit records a change of the store made by the client of the request,
+// when the audit log is enabled
+func audit(c echo.Context, conf config, action string, p string, to string, size int64) {
+	if auditor == nil {
+		return
+	}
+
+	auditor.record(auditEntry{
+		Time:   time.Now().Format(time.RFC3339),
+		IP:     c.RealIP(),
+		Store:  conf.StoreName,
+		Action: action,
+		Path:   p,
+		To:     to,
+		Size:   size,
+	})
+}
@@ -0,0 +1,114 @@
+// upl
+//
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// parseCredentials splits a user:password string
+func parseCredentials(s string) (string, string, error) {
+	user, pass, ok := cut(strings.TrimSpace(s), ":")
+	if !ok || user == "" || pass == "" {
+		return "", "", fmt.Errorf("credentials must be in the form user:password")
+	}
+	return user, pass, nil
+}
+
+// readCredentialsFile reads a user:hash line from a file, the hash being a
+// bcrypt hash as produced by htpasswd -B
+func readCredentialsFile(name string) (string, string, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return "", "", err
+	}
+
+	user, hash, err := parseCredentials(string(data))
+	if err != nil {
+		return "", "", fmt.Errorf("%s: %w", name, err)
+	}
+
+	if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+		return "", "", fmt.Errorf("%s: invalid bcrypt hash: %w", name, err)
+	}
+
+	return user, hash, nil
+}
+
+// Routes reachable without authentication
+var publicPaths = map[string]bool{
+	"/metrics":     true,
+	"/version":     true,
+	"/api/stats":   true,
+	"/favicon.ico": true,
+}
+
+// basicAuth returns a middleware requiring the credentials from the
+// configuration. The password is either compared to the plaintext, in
+// constant time, or checked against the bcrypt hash.
+func basicAuth(conf config) echo.MiddlewareFunc {
+	validator := func(user, pass string, c echo.Context) (bool, error) {
+		userOk := subtle.ConstantTimeCompare([]byte(user), []byte(conf.AuthUser)) == 1
+
+		var passOk bool
+		if conf.AuthHash != "" {
+			passOk = bcrypt.CompareHashAndPassword([]byte(conf.AuthHash), []byte(pass)) == nil
+		} else {
+			passOk = subtle.ConstantTimeCompare([]byte(pass), []byte(conf.AuthPassword)) == 1
+		}
+
+		return userOk && passOk, nil
+	}
+
+	return middleware.BasicAuthWithConfig(middleware.BasicAuthConfig{
+		Skipper: func(c echo.Context) bool {
+			// CORS preflight requests never carry credentials
+			if c.Request().Method == http.MethodOptions {
+				return true
+			}
+			if isSignedRequest(c, conf) {
+				return true
+			}
+			return publicPaths[strings.TrimPrefix(c.Path(), conf.RootPath)]
+		},
+		Validator: validator,
+	})
+}
+
+// cut slices s around the first instance of sep
+func cut(s, sep string) (string, string, bool) {
+	if i := strings.Index(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
@@ -0,0 +1,226 @@
+// upl
+//
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"hash"
+	"io"
+	"net/http"
+	"net/textproto"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Maximum number of digests kept by the cache of checksums, an entry chosen at
+// random is evicted to make room for a new one when it is full
+const maxChecksumEntries = 10000
+
+// A checksumCache keeps the digests of files to avoid hashing them on every
+// request. An entry is valid as long as the size and modification time of the
+// file are unchanged.
+type checksumCache struct {
+	mu      sync.Mutex
+	entries map[string]checksumEntry
+}
+
+type checksumEntry struct {
+	size    int64
+	modTime time.Time
+	sum     string
+}
+
+var checksums = &checksumCache{entries: make(map[string]checksumEntry)}
+
+// get returns the hex encoded SHA-256 digest of the file name of the store of
+// a handler
+func (cc *checksumCache) get(conf config, name string) (string, error) {
+	st := storeStorage(conf)
+	fe, err := st.Stat(name)
+	if err != nil {
+		return "", err
+	}
+
+	key := conf.StoreName + ":" + name
+	cc.mu.Lock()
+	e, ok := cc.entries[key]
+	cc.mu.Unlock()
+
+	if ok && e.size == fe.Size && e.modTime.Equal(fe.ModTime) {
+		return e.sum, nil
+	}
+
+	sum, err := fileSHA256(st, name)
+	if err != nil {
+		return "", err
+	}
+
+	cc.mu.Lock()
+	if _, ok := cc.entries[key]; !ok && len(cc.entries) >= maxChecksumEntries {
+		for k := range cc.entries {
+			delete(cc.entries, k)
+			break
+		}
+	}
+	cc.entries[key] = checksumEntry{size: fe.Size, modTime: fe.ModTime, sum: sum}
+	cc.mu.Unlock()
+
+	return sum, nil
+}
+
+// fileSHA256 computes the hex encoded SHA-256 digest of a file of a storage
+func fileSHA256(st storage, name string) (string, error) {
+	f, err := st.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func fileChecksum(c echo.Context, conf config) error {
+
+	st := storeStorage(conf)
+	rel, err := storageDir(st, c.QueryParam("path"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+
+	name, err := cleanFilename(c.Param("name"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+	if isReservedFile(name) {
+		return echo.NewHTTPError(http.StatusNotFound, "no such file: "+name)
+	}
+	p := path.Join(rel, name)
+
+	fe, err := st.Stat(p)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "no such file: "+name)
+	}
+
+	// The route shadows files named sha256 at the first level of
+	// subdirectories, serve them as the static handler would
+	if fe.IsDir {
+		if rel != "" {
+			return echo.NewHTTPError(http.StatusNotFound, "no such file: "+name)
+		}
+		return serveStoreFile(c, conf, path.Join(p, "sha256"))
+	}
+
+	// The digest tells about the contents of a protected file
+	if err := checkFilePassword(c, conf, st, p); err != nil {
+		return err
+	}
+
+	sum, err := checksums.get(conf, p)
+	if err != nil {
+		return err
+	}
+
+	return c.String(http.StatusOK, sum+"\n")
+}
+
+// Header giving the hex encoded SHA-256 digest of an uploaded file, in the
+// request for a single file or in the header of the part of each file
+const checksumHeader = "X-Checksum-SHA256"
+
+// expectedChecksum returns the digest announced by the client for a file of
+// the upload, from the header of its part or, for a single file, from the
+// header of the request. It is empty when the client announces none.
+func expectedChecksum(req http.Header, part textproto.MIMEHeader, single bool) (string, error) {
+	want := part.Get(checksumHeader)
+	if want == "" && req.Get(checksumHeader) != "" {
+		if !single {
+			return "", echo.NewHTTPError(http.StatusBadRequest,
+				"the "+checksumHeader+" header of the request only applies to a single file, give it in the header of each part")
+		}
+		want = req.Get(checksumHeader)
+	}
+	if want == "" {
+		return "", nil
+	}
+
+	want = strings.ToLower(strings.TrimSpace(want))
+	if b, err := hex.DecodeString(want); err != nil || len(b) != sha256.Size {
+		return "", echo.NewHTTPError(http.StatusBadRequest, "invalid "+checksumHeader+": "+want)
+	}
+	return want, nil
+}
+
+// A checksumReader hashes the contents read from r, their digest is compared
+// to the expected one by check once they are all read
+type checksumReader struct {
+	r    io.Reader
+	h    hash.Hash
+	want string
+	name string
+}
+
+func newChecksumReader(r io.Reader, want string, name string) *checksumReader {
+	return &checksumReader{r: r, h: sha256.New(), want: want, name: name}
+}
+
+func (cr *checksumReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.h.Write(p[:n])
+	return n, err
+}
+
+// check returns the 422 error when the digest of the contents read does not
+// match the expected one
+func (cr *checksumReader) check() error {
+	if got := hex.EncodeToString(cr.h.Sum(nil)); got != cr.want {
+		return echo.NewHTTPError(http.StatusUnprocessableEntity,
+			fmt.Sprintf("checksum mismatch for %s: expected %s, got %s", cr.name, cr.want, got))
+	}
+	return nil
+}
+
+// verifyChecksum reads the contents of a buffered upload to check their
+// digest, when the client announced one
+func verifyChecksum(r io.Reader, want string, name string) error {
+	if want == "" {
+		return nil
+	}
+	cr := newChecksumReader(r, want, name)
+	if _, err := io.Copy(io.Discard, cr); err != nil {
+		return err
+	}
+	return cr.check()
+}
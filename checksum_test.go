@@ -0,0 +1,193 @@
+// upl
+//
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"golang.org/x/crypto/bcrypt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestChecksumReader(t *testing.T) {
+	tests := []struct {
+		data string
+		want string
+		ok   bool
+	}{
+		{"hello\n", sha256Hex("hello\n"), true},
+		{"hello\n", sha256Hex("hello"), false},
+		{"", sha256Hex(""), true},
+	}
+
+	for _, tt := range tests {
+		err := verifyChecksum(strings.NewReader(tt.data), tt.want, "test.txt")
+		if (err == nil) != tt.ok {
+			t.Errorf("verifyChecksum(%q, %s): got error %v", tt.data, tt.want, err)
+		}
+	}
+}
+
+func TestUploadChecksum(t *testing.T) {
+	for _, stream := range []bool{false, true} {
+		conf := testConfig(t)
+		conf.StreamUploads = stream
+		ts := testServer(t, conf)
+
+		tests := []struct {
+			name   string
+			data   string
+			sum    string
+			status int
+		}{
+			{"match.txt", "some contents\n", sha256Hex("some contents\n"), http.StatusCreated},
+			{"upper.txt", "some contents\n", strings.ToUpper(sha256Hex("some contents\n")), http.StatusCreated},
+			{"mismatch.txt", "some contents\n", sha256Hex("other contents\n"), http.StatusUnprocessableEntity},
+			{"invalid.txt", "some contents\n", "not-a-digest", http.StatusBadRequest},
+		}
+
+		for _, tt := range tests {
+			parts := []testPart{{filename: tt.name, data: tt.data, header: map[string]string{checksumHeader: tt.sum}}}
+			res := postFiles(t, ts.URL+"/api/upload", conf.UploadField, parts, nil)
+			if res.StatusCode != tt.status {
+				t.Errorf("stream=%v %s: got status %d, want %d", stream, tt.name, res.StatusCode, tt.status)
+			}
+
+			_, err := os.Stat(filepath.Join(conf.StoreDir, tt.name))
+			if stored := err == nil; stored != (tt.status == http.StatusCreated) {
+				t.Errorf("stream=%v %s: stored is %v", stream, tt.name, stored)
+			}
+		}
+
+		// The header of the request applies to a single file
+		res := postFiles(t, ts.URL+"/api/upload", conf.UploadField, []testPart{{filename: "single.txt", data: "abc"}},
+			map[string]string{checksumHeader: sha256Hex("abd")})
+		if res.StatusCode != http.StatusUnprocessableEntity {
+			t.Errorf("stream=%v: got status %d for a mismatch in the request header", stream, res.StatusCode)
+		}
+
+		// Nothing but the stored files is left in the store
+		entries, err := os.ReadDir(conf.StoreDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range entries {
+			if isInternalFile(e.Name()) {
+				t.Errorf("stream=%v: temporary file left in the store: %s", stream, e.Name())
+			}
+		}
+	}
+}
+
+func TestFileChecksum(t *testing.T) {
+	conf := testConfig(t)
+	ts := testServer(t, conf)
+
+	if err := os.WriteFile(filepath.Join(conf.StoreDir, "a.txt"), []byte("hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(name string) (int, string) {
+		res, err := http.Get(ts.URL + "/files/" + name + "/sha256")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, _ := io.ReadAll(res.Body)
+		return res.StatusCode, string(body)
+	}
+
+	if code, body := get("a.txt"); code != http.StatusOK || body != sha256Hex("hello\n")+"\n" {
+		t.Errorf("got %d %q", code, body)
+	}
+
+	// The cached digest changes with the contents
+	if err := os.WriteFile(filepath.Join(conf.StoreDir, "a.txt"), []byte("hello, world\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if code, body := get("a.txt"); code != http.StatusOK || body != sha256Hex("hello, world\n")+"\n" {
+		t.Errorf("got %d %q after a change", code, body)
+	}
+
+	if code, _ := get("missing.txt"); code != http.StatusNotFound {
+		t.Errorf("got %d for a missing file", code)
+	}
+	if code, _ := get(".a.txt.upl.json"); code != http.StatusNotFound {
+		t.Errorf("got %d for a metadata file", code)
+	}
+
+	// The digest of a protected file requires its password
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := saveMeta(storeStorage(conf), "a.txt", fileMeta{PasswordHash: string(hash)}); err != nil {
+		t.Fatal(err)
+	}
+	if code, body := get("a.txt"); code != http.StatusUnauthorized || strings.Contains(body, sha256Hex("hello, world\n")) {
+		t.Errorf("got %d %q for a protected file", code, body)
+	}
+
+	for pass, status := range map[string]int{"secret": http.StatusOK, "wrong": http.StatusUnauthorized} {
+		res, err := http.PostForm(ts.URL+"/files/a.txt/sha256", url.Values{passwordField: {pass}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != status {
+			t.Errorf("got %d with password %q, want %d", res.StatusCode, pass, status)
+		}
+	}
+}
+
+func TestChecksumCacheBound(t *testing.T) {
+	conf := testConfig(t)
+	if err := os.WriteFile(filepath.Join(conf.StoreDir, "a.txt"), []byte("hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cc := &checksumCache{entries: make(map[string]checksumEntry)}
+	for i := 0; i < maxChecksumEntries; i++ {
+		cc.entries[string(rune(i))] = checksumEntry{}
+	}
+	if _, err := cc.get(conf, "a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if len(cc.entries) != maxChecksumEntries {
+		t.Errorf("got %d entries, want %d", len(cc.entries), maxChecksumEntries)
+	}
+}
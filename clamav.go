@@ -0,0 +1,150 @@
+// upl
+//
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Size of the chunks streamed to clamd and maximum duration of a scan
+const (
+	clamdChunkSize = 64 * 1024
+	clamdTimeout   = 2 * time.Minute
+)
+
+// parseClamdAddr splits the address of clamd into the network and address to
+// dial, either unix:/path/to/socket or a tcp host:port, optionally prefixed
+// with tcp:
+func parseClamdAddr(v string) (string, string, error) {
+	if strings.HasPrefix(v, socketPrefix) {
+		p := strings.TrimPrefix(v, socketPrefix)
+		if p == "" {
+			return "", "", errors.New("missing socket path")
+		}
+		return "unix", p, nil
+	}
+
+	hostPort := strings.TrimPrefix(v, "tcp:")
+	if _, _, err := net.SplitHostPort(hostPort); err != nil {
+		return "", "", err
+	}
+	return "tcp", hostPort, nil
+}
+
+// clamdScan sends the contents of r to clamd with the INSTREAM command. It
+// returns the name of the signature found, empty when the contents are clean.
+func clamdScan(addr string, r io.Reader) (string, error) {
+	network, address, err := parseClamdAddr(addr)
+	if err != nil {
+		return "", err
+	}
+
+	conn, err := net.DialTimeout(network, address, clamdTimeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(clamdTimeout))
+
+	// The command is followed by chunks prefixed by their length as a 32
+	// bit big endian integer, a zero length chunk ends the stream
+	if _, err := io.WriteString(conn, "zINSTREAM\x00"); err != nil {
+		return "", err
+	}
+
+	buf := make([]byte, 4+clamdChunkSize)
+	for {
+		n, err := io.ReadFull(r, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf[:4], uint32(n))
+			if _, werr := conn.Write(buf[:4+n]); werr != nil {
+				return "", werr
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return "", err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	reply = strings.TrimRight(reply, "\x00\n")
+
+	// Replies are "stream: OK", "stream: <signature> FOUND" or a message
+	// ending with ERROR
+	status := strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case status == "OK":
+		return "", nil
+	case strings.HasSuffix(status, " FOUND"):
+		return strings.TrimSuffix(status, " FOUND"), nil
+	default:
+		return "", fmt.Errorf("clamd: %s", reply)
+	}
+}
+
+// scanUpload checks the contents of an uploaded file with clamd when it is
+// configured. Infected files are rejected with the 422 status, the upload
+// fails with the 503 status when clamd cannot be reached.
+func scanUpload(conf config, name string, r io.Reader) error {
+	if conf.ClamAV == "" {
+		return nil
+	}
+
+	sig, err := clamdScan(conf.ClamAV, r)
+	if err != nil {
+		return &echo.HTTPError{
+			Code:     http.StatusServiceUnavailable,
+			Message:  "could not scan " + name,
+			Internal: err,
+		}
+	}
+
+	if sig != "" {
+		return echo.NewHTTPError(http.StatusUnprocessableEntity,
+			fmt.Sprintf("%s is infected: %s", name, sig))
+	}
+
+	return nil
+}
@@ -0,0 +1,207 @@
+// upl
+//
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/labstack/echo/v4"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Marker of the contents the fake clamd reports as infected
+const testVirus = "EICAR-TEST"
+
+// fakeClamd serves the INSTREAM command of clamd on a local TCP port until
+// the end of the test. Streams containing testVirus are reported infected,
+// the ones containing ERROR get an error reply. It returns the address to
+// give to -clamav.
+func fakeClamd(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveClamd(conn)
+		}
+	}()
+
+	return "tcp:" + l.Addr().String()
+}
+
+func serveClamd(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	cmd, err := r.ReadString(0)
+	if err != nil || cmd != "zINSTREAM\x00" {
+		io.WriteString(conn, "UNKNOWN COMMAND\x00")
+		return
+	}
+
+	var data bytes.Buffer
+	for {
+		var size uint32
+		if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+			return
+		}
+		if size == 0 {
+			break
+		}
+		if _, err := io.CopyN(&data, r, int64(size)); err != nil {
+			return
+		}
+	}
+
+	switch {
+	case bytes.Contains(data.Bytes(), []byte(testVirus)):
+		io.WriteString(conn, "stream: Eicar-Test-Signature FOUND\x00")
+	case bytes.Contains(data.Bytes(), []byte("ERROR")):
+		io.WriteString(conn, "INSTREAM size limit exceeded. ERROR\x00")
+	default:
+		io.WriteString(conn, "stream: OK\x00")
+	}
+}
+
+func TestParseClamdAddr(t *testing.T) {
+	tests := []struct {
+		in      string
+		network string
+		address string
+		ok      bool
+	}{
+		{"unix:/var/run/clamav/clamd.ctl", "unix", "/var/run/clamav/clamd.ctl", true},
+		{"127.0.0.1:3310", "tcp", "127.0.0.1:3310", true},
+		{"tcp:localhost:3310", "tcp", "localhost:3310", true},
+		{"tcp:[::1]:3310", "tcp", "[::1]:3310", true},
+		{"unix:", "", "", false},
+		{"localhost", "", "", false},
+	}
+
+	for _, tt := range tests {
+		network, address, err := parseClamdAddr(tt.in)
+		if (err == nil) != tt.ok || network != tt.network || address != tt.address {
+			t.Errorf("parseClamdAddr(%q) = %q, %q, %v", tt.in, network, address, err)
+		}
+	}
+}
+
+func TestClamdScan(t *testing.T) {
+	addr := fakeClamd(t)
+
+	// Files larger than a chunk are streamed in several of them, with a
+	// signature across their boundary
+	large := strings.Repeat("x", clamdChunkSize-4) + testVirus + strings.Repeat("x", clamdChunkSize)
+
+	tests := []struct {
+		data string
+		sig  string
+		ok   bool
+	}{
+		{"clean contents", "", true},
+		{"", "", true},
+		{"infected " + testVirus + " contents", "Eicar-Test-Signature", true},
+		{large, "Eicar-Test-Signature", true},
+		{strings.Repeat("y", 3*clamdChunkSize), "", true},
+		{"ERROR", "", false},
+	}
+
+	for _, tt := range tests {
+		sig, err := clamdScan(addr, strings.NewReader(tt.data))
+		if (err == nil) != tt.ok || sig != tt.sig {
+			t.Errorf("clamdScan of %d bytes = %q, %v, want %q", len(tt.data), sig, err, tt.sig)
+		}
+	}
+}
+
+func TestScanUploadUnavailable(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	conf := newConfig()
+	conf.ClamAV = addr
+	err = scanUpload(conf, "a.txt", strings.NewReader("contents"))
+
+	var he *echo.HTTPError
+	if !errors.As(err, &he) || he.Code != http.StatusServiceUnavailable {
+		t.Errorf("got error %v, want the 503 status", err)
+	}
+}
+
+func TestUploadClamAV(t *testing.T) {
+	addr := fakeClamd(t)
+
+	for _, stream := range []bool{false, true} {
+		conf := testConfig(t)
+		conf.ClamAV = addr
+		conf.StreamUploads = stream
+		ts := testServer(t, conf)
+
+		res := postFiles(t, ts.URL+"/api/upload", conf.UploadField, []testPart{{filename: "clean.txt", data: "clean"}}, nil)
+		if res.StatusCode != http.StatusCreated {
+			t.Errorf("stream=%v: got %d for a clean file", stream, res.StatusCode)
+		}
+
+		// An infected file never replaces the existing one
+		if err := os.WriteFile(filepath.Join(conf.StoreDir, "report.pdf"), []byte("previous"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		res = postFiles(t, ts.URL+"/api/upload", conf.UploadField, []testPart{{filename: "report.pdf", data: testVirus}}, nil)
+		body, _ := io.ReadAll(res.Body)
+		if res.StatusCode != http.StatusUnprocessableEntity || !strings.Contains(string(body), "infected") {
+			t.Errorf("stream=%v: got %d %s for an infected file", stream, res.StatusCode, body)
+		}
+		if got := readStoreFile(t, conf, "report.pdf"); got != "previous" {
+			t.Errorf("stream=%v: infected file stored", stream)
+		}
+
+		names := storeEntries(t, conf)
+		if len(names) != 2 {
+			t.Errorf("stream=%v: got entries %v", stream, names)
+		}
+	}
+}
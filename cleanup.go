@@ -0,0 +1,138 @@
+// upl
+//
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"context"
+	"github.com/labstack/gommon/bytes"
+	"io/fs"
+	"log"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// How often the free space of the disk of the stores is checked
+const lowSpaceInterval = time.Minute
+
+// freeSpace periodically removes the oldest files of the store while the
+// free space of its disk is below the threshold, until the context is done
+func freeSpace(ctx context.Context, conf config) {
+	ticker := time.NewTicker(lowSpaceInterval)
+	defer ticker.Stop()
+
+	for {
+		if removeOldest(conf) {
+			storeUsage(conf).invalidate()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// diskFree returns the number of bytes available on the filesystem holding
+// dir
+func diskFree(dir string) (uint64, error) {
+	free, _, err := diskSpace(dir)
+	return free, err
+}
+
+// A storeFileAge is a file of the store and its modification time
+type storeFileAge struct {
+	rel     string
+	modTime time.Time
+}
+
+// removeOldest removes files of the store, oldest first, until the free
+// space is above the threshold. Files modified less than the minimum age
+// ago are kept. It tells if files were removed.
+func removeOldest(conf config) bool {
+	free, err := diskFree(conf.StoreDir)
+	if err != nil {
+		log.Println("could not get free disk space:", err)
+		return false
+	}
+	if free >= uint64(conf.LowSpace) {
+		return false
+	}
+
+	keepAfter := time.Now().Add(-conf.LowSpaceMinAge)
+	files := make([]storeFileAge, 0)
+	filepath.WalkDir(conf.StoreDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			log.Println("could not look for files to remove:", err)
+			return nil
+		}
+
+		if !d.Type().IsRegular() || isInternalFile(d.Name()) || isMetaFile(d.Name()) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil || info.ModTime().After(keepAfter) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(conf.StoreDir, p)
+		if err != nil {
+			return nil
+		}
+		files = append(files, storeFileAge{rel: filepath.ToSlash(rel), modTime: info.ModTime()})
+
+		return nil
+	})
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+
+	removed := false
+	for _, f := range files {
+		if err := removeStoreFile(conf.StoreDir, f.rel); err != nil {
+			log.Println("could not remove file to free space:", err)
+			continue
+		}
+		removed = true
+
+		free, err = diskFree(conf.StoreDir)
+		if err != nil {
+			log.Println("could not get free disk space:", err)
+			return removed
+		}
+		log.Printf("removed file to free space: %s, %s free", f.rel, bytes.Format(int64(free)))
+
+		if free >= uint64(conf.LowSpace) {
+			return removed
+		}
+	}
+
+	log.Printf("disk space is low, %s free, and no file old enough is left to remove", bytes.Format(int64(free)))
+	return removed
+}
@@ -0,0 +1,92 @@
+// upl
+//
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Header of the entity tags of contents the client does not upload when the
+// store already has them
+const ifNoneMatchHeader = "If-None-Match"
+
+// indexDigests tells if the digests of the uploaded files are kept in the
+// dedup index of the store
+func (c config) indexDigests() bool {
+	return c.Dedup || c.ConditionalUploads
+}
+
+// existingUpload looks for a file of the store having one of the SHA-256
+// digests given as entity tags in the If-None-Match header of the request.
+// It is checked before reading the body, so that a client can avoid sending
+// contents the store already has. Only the files uploaded while the digests
+// are indexed can be found. The upload form does not use it, its answer is
+// the listing of the directory given in the body.
+func existingUpload(c echo.Context, conf config) (storedFile, bool, error) {
+	header := c.Request().Header.Get(ifNoneMatchHeader)
+	if !conf.indexDigests() || header == "" {
+		return storedFile{}, false, nil
+	}
+
+	sums := make([]string, 0)
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		sum := strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(tag, `"`), `"`))
+		if b, err := hex.DecodeString(sum); err != nil || len(b) != sha256.Size || len(tag) != len(sum)+2 {
+			return storedFile{}, false, echo.NewHTTPError(http.StatusBadRequest,
+				"invalid "+ifNoneMatchHeader+": expected quoted SHA-256 digests, got "+strings.TrimSpace(header))
+		}
+		sums = append(sums, sum)
+	}
+
+	di := dedupFiles(conf.StoreDir)
+	for _, sum := range sums {
+		p, ok := di.lookup(conf.StoreDir, sum)
+		if !ok {
+			continue
+		}
+		fi, err := os.Stat(filepath.Join(conf.StoreDir, filepath.FromSlash(p)))
+		if err != nil {
+			continue
+		}
+
+		return storedFile{
+			Name:   fi.Name(),
+			Path:   p,
+			Size:   fi.Size(),
+			URL:    fileURL(conf.BasePath, p),
+			Exists: true,
+		}, true, nil
+	}
+
+	return storedFile{}, false, nil
+}
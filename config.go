@@ -0,0 +1,205 @@
+// upl
+//
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Flags that cannot be set from the configuration file or the environment
+var cliOnlyFlags = map[string]bool{
+	"config":      true,
+	"dump-config": true,
+	"help":        true,
+	"version":     true,
+}
+
+// Fields of the configuration hidden when it is dumped
+var secretFields = map[string]bool{
+	"AuthPassword": true,
+	"AuthHash":     true,
+	"Secret":       true,
+	"S3SecretKey":  true,
+}
+
+// envName returns the name of the environment variable setting a flag
+func envName(flagName string) string {
+	return "UPL_" + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// readConfigFile reads a JSON object mapping flag names to values. Values can
+// be strings, numbers, booleans or arrays of those for flags that can be
+// repeated.
+func readConfigFile(name string) (map[string][]string, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw map[string]interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	values := make(map[string][]string, len(raw))
+	for k, v := range raw {
+		switch t := v.(type) {
+		case []interface{}:
+			for _, e := range t {
+				values[k] = append(values[k], fmt.Sprint(e))
+			}
+		case map[string]interface{}, nil:
+			return nil, fmt.Errorf("%s: invalid value for %s", name, k)
+		default:
+			values[k] = []string{fmt.Sprint(t)}
+		}
+	}
+
+	return values, nil
+}
+
+// applyConfigLayers sets the flags that were not given on the command line,
+// first from the configuration file, then from the environment. This gives
+// the precedence order defaults < configuration file < environment < command
+// line, while each value goes through the same parsing as the command line.
+func applyConfigLayers(fs *flag.FlagSet, configFile string) error {
+	cli := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { cli[f.Name] = true })
+
+	if configFile != "" {
+		values, err := readConfigFile(configFile)
+		if err != nil {
+			return err
+		}
+
+		names := make([]string, 0, len(values))
+		for name := range values {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			if fs.Lookup(name) == nil || cliOnlyFlags[name] {
+				return fmt.Errorf("%s: unknown option %s", configFile, name)
+			}
+			if cli[name] {
+				continue
+			}
+			for _, v := range values[name] {
+				if err := fs.Set(name, v); err != nil {
+					return fmt.Errorf("%s: invalid value for %s: %w", configFile, name, err)
+				}
+			}
+		}
+	}
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || cli[f.Name] || cliOnlyFlags[f.Name] {
+			return
+		}
+		if v, ok := os.LookupEnv(envName(f.Name)); ok {
+			// Values of repeatable options set from the configuration
+			// file are replaced, not extended
+			if r, ok := f.Value.(interface{ Reset() }); ok {
+				r.Reset()
+			}
+			if e := fs.Set(f.Name, v); e != nil {
+				err = fmt.Errorf("invalid value for %s: %w", envName(f.Name), e)
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	// UPL_PORT only changes the port of a single TCP listen address
+	l, _ := fs.Lookup("listen").Value.(*listenFlag)
+	if port, ok := os.LookupEnv("UPL_PORT"); ok && !cli["listen"] && l != nil && len(l.values) == 1 && !strings.HasPrefix(l.values[0], socketPrefix) {
+		h, _, err := net.SplitHostPort(l.values[0])
+		if err != nil {
+			return fmt.Errorf("invalid listen address: %w", err)
+		}
+		l.Reset()
+		if err := fs.Set("listen", net.JoinHostPort(h, port)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeConfig writes the configuration as a JSON object, with its fields in
+// the order of the struct. Durations and file modes are given as they are on
+// the command line, secrets are redacted.
+func writeConfig(w io.Writer, c config) error {
+	v := reflect.ValueOf(c)
+	t := v.Type()
+
+	var b strings.Builder
+	b.WriteString("{\n")
+	for i := 0; i < t.NumField(); i++ {
+		name := t.Field(i).Name
+		var value interface{}
+		switch f := v.Field(i).Interface().(type) {
+		case time.Duration:
+			value = f.String()
+		case os.FileMode:
+			value = fmt.Sprintf("%o", f)
+		case string:
+			value = f
+			if secretFields[name] && f != "" {
+				value = "REDACTED"
+			}
+		default:
+			value = f
+		}
+
+		data, err := json.Marshal(value)
+		if err != nil {
+			return fmt.Errorf("could not encode %s: %w", name, err)
+		}
+
+		sep := ","
+		if i == t.NumField()-1 {
+			sep = ""
+		}
+		fmt.Fprintf(&b, "  %q: %s%s\n", name, data, sep)
+	}
+	b.WriteString("}\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
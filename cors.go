@@ -0,0 +1,81 @@
+// upl
+//
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// parseOrigins splits a comma separated list of origins allowed to call the
+// API from a browser. Each origin is either * or a scheme://host[:port] URL.
+func parseOrigins(s string) ([]string, error) {
+	origins := make([]string, 0)
+	for _, o := range strings.Split(s, ",") {
+		o = strings.TrimRight(strings.TrimSpace(o), "/")
+		if o == "" {
+			continue
+		}
+
+		if o != "*" {
+			u, err := url.Parse(o)
+			if err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" {
+				return nil, fmt.Errorf("%s: origins must be given as scheme://host[:port]", o)
+			}
+		}
+		origins = append(origins, o)
+	}
+
+	return origins, nil
+}
+
+// apiCORS returns the middleware answering preflight requests and adding the
+// CORS headers to the responses of the API routes, nil when no origin is
+// allowed. Browsers only send credentials to explicitly allowed origins, so
+// they are never allowed with *.
+func apiCORS(conf config) echo.MiddlewareFunc {
+	if len(conf.CORSOrigins) == 0 {
+		return nil
+	}
+
+	credentials := true
+	for _, o := range conf.CORSOrigins {
+		if o == "*" {
+			credentials = false
+		}
+	}
+
+	return middleware.CORSWithConfig(middleware.CORSConfig{
+		AllowOrigins:     conf.CORSOrigins,
+		AllowMethods:     []string{http.MethodGet, http.MethodPost},
+		AllowCredentials: credentials,
+		ExposeHeaders:    []string{headerTotalCount},
+	})
+}
@@ -0,0 +1,191 @@
+// upl
+//
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Name of the file, at the root of the store, where download counts are
+// saved
+const downloadIndexFile = ".upl-downloads.json"
+
+// How often download counts are saved
+const downloadSaveInterval = time.Minute
+
+// A downloadCounter counts how many times files were downloaded, by path
+// relative to the store directory
+type downloadCounter struct {
+	mu     sync.Mutex
+	file   string
+	counts map[string]int64
+	dirty  bool
+}
+
+// Download counters by store directory
+var (
+	downloadCountersMu sync.Mutex
+	downloadCounters   = make(map[string]*downloadCounter)
+)
+
+// downloadCounts returns the download counter of a store, loaded from the
+// index file of the store on first use
+func downloadCounts(storeDir string) *downloadCounter {
+	downloadCountersMu.Lock()
+	defer downloadCountersMu.Unlock()
+
+	dc, ok := downloadCounters[storeDir]
+	if !ok {
+		dc = &downloadCounter{
+			file:   filepath.Join(storeDir, downloadIndexFile),
+			counts: make(map[string]int64),
+		}
+		downloadCounters[storeDir] = dc
+	}
+
+	return dc
+}
+
+// load reads the counts from their file, a missing file gives no counts
+func (dc *downloadCounter) load() error {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	data, err := os.ReadFile(dc.file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	return json.Unmarshal(data, &dc.counts)
+}
+
+// save writes the counts to their file when they have changed
+func (dc *downloadCounter) save() error {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	if !dc.dirty || dc.file == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(dc.counts)
+	if err != nil {
+		return err
+	}
+
+	tmp := dc.file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dc.file); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	dc.dirty = false
+	return nil
+}
+
+func (dc *downloadCounter) increment(rel string) {
+	dc.mu.Lock()
+	dc.counts[rel]++
+	dc.dirty = true
+	dc.mu.Unlock()
+}
+
+// reset forgets the count of a file, when it is removed or replaced by a new
+// upload
+func (dc *downloadCounter) reset(rel string) {
+	dc.mu.Lock()
+	if _, ok := dc.counts[rel]; ok {
+		delete(dc.counts, rel)
+		dc.dirty = true
+	}
+	dc.mu.Unlock()
+}
+
+// move keeps the count of a renamed file, replacing the count of the file it
+// may overwrite
+func (dc *downloadCounter) move(from string, to string) {
+	dc.mu.Lock()
+	n, ok := dc.counts[from]
+	_, replaced := dc.counts[to]
+	if ok {
+		delete(dc.counts, from)
+		dc.counts[to] = n
+	} else {
+		delete(dc.counts, to)
+	}
+	if ok || replaced {
+		dc.dirty = true
+	}
+	dc.mu.Unlock()
+}
+
+func (dc *downloadCounter) count(rel string) int64 {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	return dc.counts[rel]
+}
+
+// addDownloadCounts sets the download count of the regular files of a listing
+func addDownloadCounts(files []fileEntry, storeDir string) {
+	dc := downloadCounts(storeDir)
+	for i := range files {
+		if !files[i].IsDir {
+			files[i].Downloads = dc.count(files[i].Path)
+		}
+	}
+}
+
+// saveDownloadCounts periodically saves the download counts of the store
+// until the context is done
+func saveDownloadCounts(ctx context.Context, conf config) {
+	ticker := time.NewTicker(downloadSaveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := downloadCounts(conf.StoreDir).save(); err != nil {
+			log.Println("could not save download counts:", err)
+		}
+	}
+}
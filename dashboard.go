@@ -0,0 +1,155 @@
+// upl
+//
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/bytes"
+	"html/template"
+	"net/http"
+	"time"
+)
+
+// With a single store and the dashboard, the listing of the store moves to
+// this path, the dashboard taking the root
+const dashboardStorePath = "browse"
+
+// A storeStats summarizes the contents of a store on the dashboard
+type storeStats struct {
+	Name  string `json:"name"`
+	URL   string `json:"url"`
+	Files int    `json:"files"`
+	Size  int64  `json:"size"`
+	// Free space and size of the filesystem of the store, unknown with the
+	// S3 backend or when they cannot be found
+	Free *uint64 `json:"free,omitempty"`
+	Disk *uint64 `json:"disk,omitempty"`
+}
+
+// HumanSize returns the total size of the files in a human readable form
+func (s storeStats) HumanSize() string {
+	return bytes.Format(s.Size)
+}
+
+// HumanFree returns the free space in a human readable form, empty when
+// unknown
+func (s storeStats) HumanFree() string {
+	if s.Free == nil {
+		return ""
+	}
+	return bytes.Format(int64(*s.Free))
+}
+
+// collectStoreStats returns the number of files, the space used and the disk
+// space of each store, with the totals of all stores
+func collectStoreStats(conf config) ([]storeStats, storeStats, error) {
+	stores := make([]storeStats, 0, len(conf.Stores)+1)
+	var total storeStats
+	for _, sc := range conf.storeConfigs() {
+		files, size, err := storeUsage(sc).stats(storeStorage(sc))
+		if err != nil {
+			return nil, total, err
+		}
+
+		s := storeStats{
+			Name:  sc.StoreName,
+			URL:   sc.BasePath + "/",
+			Files: files,
+			Size:  size,
+		}
+		if sc.Backend == backendLocal {
+			if free, disk, err := diskSpace(sc.StoreDir); err == nil {
+				s.Free = &free
+				s.Disk = &disk
+			}
+		}
+		stores = append(stores, s)
+
+		total.Files += files
+		total.Size += size
+	}
+
+	return stores, total, nil
+}
+
+// dashboard shows the number of files, the space used and the free disk space
+// of each store, with links to their listings
+func dashboard(c echo.Context, conf config) error {
+	stores, total, err := collectStoreStats(conf)
+	if err != nil {
+		return err
+	}
+
+	if wantsJSON(c) {
+		return c.JSON(http.StatusOK, stores)
+	}
+
+	v := struct {
+		Root     string
+		BasePath string
+		Title    string
+		Footer   template.HTML
+		Stores   []storeStats
+		Total    storeStats
+	}{
+		Root:     conf.RootPath,
+		BasePath: conf.BasePath,
+		Title:    conf.Title,
+		Footer:   template.HTML(conf.Footer),
+		Stores:   stores,
+		Total:    total,
+	}
+
+	return c.Render(http.StatusOK, "dashboard.html", v)
+}
+
+// When the server started, for its uptime
+var startTime time.Time
+
+// A statsView is the snapshot of the stores sent by the stats endpoint
+type statsView struct {
+	// Seconds since the server started
+	Uptime int64        `json:"uptime"`
+	Files  int          `json:"files"`
+	Size   int64        `json:"size"`
+	Stores []storeStats `json:"stores"`
+}
+
+// apiStats returns the number of files and the space used by all the stores,
+// and the details of each store with its disk space, as JSON
+func apiStats(c echo.Context, conf config) error {
+	stores, total, err := collectStoreStats(conf)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, statsView{
+		Uptime: int64(time.Since(startTime).Seconds()),
+		Files:  total.Files,
+		Size:   total.Size,
+		Stores: stores,
+	})
+}
@@ -0,0 +1,268 @@
+// upl
+//
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"context"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/net/webdav"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Methods of WebDAV allowed in read-only mode
+var davReadMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+	"PROPFIND":         true,
+}
+
+// davHandler returns a handler serving the directory of a store over WebDAV,
+// prefix being the URL path where it is mounted
+func davHandler(conf config, prefix string) echo.HandlerFunc {
+	h := &webdav.Handler{
+		Prefix:     prefix,
+		FileSystem: davFS{Dir: webdav.Dir(conf.StoreDir), st: storeStorage(conf)},
+		LockSystem: webdav.NewMemLS(),
+		Logger: func(r *http.Request, err error) {
+			if err != nil {
+				log.Println("webdav:", r.Method, r.URL.Path, err)
+			}
+		},
+	}
+
+	return func(c echo.Context) error {
+		if conf.DAVReadOnly && !davReadMethods[c.Request().Method] {
+			return echo.NewHTTPError(http.StatusMethodNotAllowed, "WebDAV access is read-only")
+		}
+		w := http.ResponseWriter(c.Response())
+		if m := c.Request().Method; m == http.MethodGet || m == http.MethodHead {
+			c.Response().Header().Set("X-Content-Type-Options", "nosniff")
+			w = &davReadWriter{ResponseWriter: w}
+		}
+		h.ServeHTTP(w, c.Request())
+		return nil
+	}
+}
+
+// A davReadWriter sends the files read over WebDAV as plain text when their
+// content type is active, like the downloads of /files, because the handler
+// chooses it from the extension or the content of the file
+type davReadWriter struct {
+	http.ResponseWriter
+	wrote bool
+}
+
+func (w *davReadWriter) WriteHeader(code int) {
+	if !w.wrote {
+		w.wrote = true
+		if ct := w.Header().Get(echo.HeaderContentType); ct != "" && isActiveType(ct) {
+			w.Header().Set(echo.HeaderContentType, "text/plain; charset=utf-8")
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *davReadWriter) Write(b []byte) (int, error) {
+	if !w.wrote {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// davRouter returns a middleware, to register with Pre, sending the requests
+// under the /dav path of each store to its WebDAV handler, wrapped with the
+// given middleware. The router of Echo cannot be used because it does not
+// know the methods of WebDAV, like MKCOL or MOVE.
+func davRouter(stores []config, mw []echo.MiddlewareFunc) echo.MiddlewareFunc {
+	prefixes := make([]string, 0, len(stores))
+	handlers := make(map[string]echo.HandlerFunc)
+	for _, sc := range stores {
+		prefix := sc.BasePath + "/dav"
+		h := davHandler(sc, prefix)
+		for i := len(mw) - 1; i >= 0; i-- {
+			h = mw[i](h)
+		}
+		prefixes = append(prefixes, prefix)
+		handlers[prefix] = h
+	}
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			p := c.Request().URL.Path
+			for _, prefix := range prefixes {
+				if p == prefix || strings.HasPrefix(p, prefix+"/") {
+					return handlers[prefix](c)
+				}
+			}
+			return next(c)
+		}
+	}
+}
+
+// A davFS serves the directory of a store like webdav.Dir, without the
+// internal files and sidecars of upl, which do not exist for clients, and
+// refusing access to protected files, since WebDAV clients are not asked for
+// their password
+type davFS struct {
+	webdav.Dir
+	st storage
+}
+
+// davPath returns the slash separated path relative to the store of a name
+// given by the WebDAV handler
+func davPath(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// reserved tells if one of the elements of the path p is an internal file
+// or a sidecar
+func (d davFS) reserved(p string) bool {
+	for _, e := range strings.Split(p, "/") {
+		if isReservedFile(e) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasMeta tells if the file p has a sidecar
+func (d davFS) hasMeta(p string) bool {
+	_, err := d.st.Stat(metaPath(p))
+	return err == nil
+}
+
+// protected tells if the file p has a sidecar or, when it is a directory,
+// contains files having one
+func (d davFS) protected(p string) bool {
+	if d.hasMeta(p) {
+		return true
+	}
+
+	found := false
+	filepath.WalkDir(filepath.Join(string(d.Dir), filepath.FromSlash(p)), func(_ string, e fs.DirEntry, err error) error {
+		if err == nil && !e.IsDir() && isMetaFile(e.Name()) {
+			found = true
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return found
+}
+
+// check returns the error given to the WebDAV handler for the path p
+func (d davFS) check(p string) error {
+	if d.reserved(p) {
+		return os.ErrNotExist
+	}
+	if p != "" && d.protected(p) {
+		return os.ErrPermission
+	}
+	return nil
+}
+
+func (d davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	if d.reserved(davPath(name)) {
+		return os.ErrPermission
+	}
+	return d.Dir.Mkdir(ctx, name, perm)
+}
+
+func (d davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	p := davPath(name)
+	if d.reserved(p) {
+		if flag&os.O_CREATE != 0 {
+			return nil, os.ErrPermission
+		}
+		return nil, os.ErrNotExist
+	}
+	if d.hasMeta(p) {
+		return nil, os.ErrPermission
+	}
+
+	f, err := d.Dir.OpenFile(ctx, name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return davFile{File: f, fs: d, p: p}, nil
+}
+
+func (d davFS) RemoveAll(ctx context.Context, name string) error {
+	if err := d.check(davPath(name)); err != nil {
+		return err
+	}
+	return d.Dir.RemoveAll(ctx, name)
+}
+
+func (d davFS) Rename(ctx context.Context, oldName, newName string) error {
+	if err := d.check(davPath(oldName)); err != nil {
+		return err
+	}
+	if p := davPath(newName); d.reserved(p) || d.protected(p) {
+		return os.ErrPermission
+	}
+	return d.Dir.Rename(ctx, oldName, newName)
+}
+
+func (d davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	p := davPath(name)
+	if d.reserved(p) {
+		return nil, os.ErrNotExist
+	}
+	if d.hasMeta(p) {
+		return nil, os.ErrPermission
+	}
+	return d.Dir.Stat(ctx, name)
+}
+
+// A davFile is a file of a davFS, the listing of directories leaves out the
+// entries clients cannot access
+type davFile struct {
+	webdav.File
+	fs davFS
+	p  string
+}
+
+func (f davFile) Readdir(count int) ([]os.FileInfo, error) {
+	for {
+		fis, err := f.File.Readdir(count)
+		kept := fis[:0]
+		for _, fi := range fis {
+			if !isReservedFile(fi.Name()) && !f.fs.hasMeta(path.Join(f.p, fi.Name())) {
+				kept = append(kept, fi)
+			}
+		}
+		if count <= 0 || len(kept) > 0 || err != nil {
+			return kept, err
+		}
+	}
+}
@@ -0,0 +1,225 @@
+// upl
+//
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Name of the file, at the root of the store, where the digests of the
+// stored files are saved
+const dedupIndexFile = ".upl-dedup.json"
+
+// A dedupEntry is a stored file having a given digest. The size and the
+// modification time tell if it was changed since.
+type dedupEntry struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modtime"`
+}
+
+// A dedupIndex maps the hex encoded SHA-256 digests of the uploaded files to
+// a file of the store with this content
+type dedupIndex struct {
+	mu     sync.Mutex
+	file   string
+	hashes map[string]dedupEntry
+}
+
+// Dedup indexes by store directory
+var (
+	dedupIndexesMu sync.Mutex
+	dedupIndexes   = make(map[string]*dedupIndex)
+)
+
+// dedupFiles returns the dedup index of a store, loaded from the index file
+// of the store on first use
+func dedupFiles(storeDir string) *dedupIndex {
+	dedupIndexesMu.Lock()
+	defer dedupIndexesMu.Unlock()
+
+	di, ok := dedupIndexes[storeDir]
+	if !ok {
+		di = &dedupIndex{
+			file:   filepath.Join(storeDir, dedupIndexFile),
+			hashes: make(map[string]dedupEntry),
+		}
+		if err := di.load(); err != nil {
+			log.Println("could not load dedup index:", err)
+		}
+		dedupIndexes[storeDir] = di
+	}
+
+	return di
+}
+
+// load reads the index from its file, a missing file gives an empty index
+func (di *dedupIndex) load() error {
+	data, err := os.ReadFile(di.file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	return json.Unmarshal(data, &di.hashes)
+}
+
+// save writes the index to its file, with the lock held
+func (di *dedupIndex) save() error {
+	data, err := json.Marshal(di.hashes)
+	if err != nil {
+		return err
+	}
+
+	tmp := di.file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, di.file); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return nil
+}
+
+// record remembers that the file rel of the store has the digest sum
+func (di *dedupIndex) record(sum string, rel string, fi os.FileInfo) {
+	di.mu.Lock()
+	defer di.mu.Unlock()
+
+	di.hashes[sum] = dedupEntry{Path: rel, Size: fi.Size(), ModTime: fi.ModTime()}
+	if err := di.save(); err != nil {
+		log.Println("could not save dedup index:", err)
+	}
+}
+
+// lookup returns the path of a file of the store with the digest sum, when
+// it still exists unchanged
+func (di *dedupIndex) lookup(storeDir string, sum string) (string, bool) {
+	di.mu.Lock()
+	defer di.mu.Unlock()
+
+	e, ok := di.hashes[sum]
+	if !ok {
+		return "", false
+	}
+
+	fi, err := os.Stat(filepath.Join(storeDir, filepath.FromSlash(e.Path)))
+	if err != nil || !fi.Mode().IsRegular() || fi.Size() != e.Size || !fi.ModTime().Equal(e.ModTime) {
+		delete(di.hashes, sum)
+		if err := di.save(); err != nil {
+			log.Println("could not save dedup index:", err)
+		}
+		return "", false
+	}
+
+	return e.Path, true
+}
+
+// move follows a renamed file
+func (di *dedupIndex) move(from string, to string) {
+	di.mu.Lock()
+	defer di.mu.Unlock()
+
+	for sum, e := range di.hashes {
+		if e.Path == from {
+			e.Path = to
+			di.hashes[sum] = e
+			if err := di.save(); err != nil {
+				log.Println("could not save dedup index:", err)
+			}
+			return
+		}
+	}
+}
+
+// dedupWriteFile stores the contents of src as the file p of the store like
+// writeFile, with the temporary file in tmpDir and the mode perm, hashing
+// them on the way. With link, when a file of the store already has
+// the same contents, p becomes a hard link to it instead of a copy. Where
+// hard links are not supported, the copy is kept. Otherwise, the digest is
+// only recorded.
+func dedupWriteFile(storeDir string, tmpDir string, perm os.FileMode, p string, src io.Reader, link bool) error {
+	filename := filepath.Join(storeDir, filepath.FromSlash(p))
+
+	h := sha256.New()
+	if err := writeFile(filename, tmpDir, perm, io.TeeReader(src, h)); err != nil {
+		return err
+	}
+
+	return dedupFile(storeDir, p, hex.EncodeToString(h.Sum(nil)), link)
+}
+
+// dedupFile records that the file p of the store has the digest sum. With
+// link, when another file of the store has the same contents, p becomes a
+// hard link to it, like with dedupWriteFile.
+func dedupFile(storeDir string, p string, sum string, link bool) error {
+	filename := filepath.Join(storeDir, filepath.FromSlash(p))
+
+	di := dedupFiles(storeDir)
+	if orig, ok := di.lookup(storeDir, sum); link && ok && orig != p {
+		if err := replaceWithLink(filepath.Join(storeDir, filepath.FromSlash(orig)), filename); err != nil {
+			log.Printf("could not link %s to %s, keeping a copy: %s", p, orig, err)
+		} else {
+			return nil
+		}
+	}
+
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+	di.record(sum, p, fi)
+
+	return nil
+}
+
+// replaceWithLink atomically replaces filename with a hard link to orig
+func replaceWithLink(orig string, filename string) error {
+	tmp := filepath.Join(filepath.Dir(filename), ".upl-"+filepath.Base(filename)+".link")
+	os.Remove(tmp)
+	if err := os.Link(orig, tmp); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, filename); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return nil
+}
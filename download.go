@@ -0,0 +1,239 @@
+// upl
+//
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Number of bytes used to detect the content type of a file
+const sniffLen = 512
+
+// serveFile sends a file of the store. It is also registered on
+// /files/:name, otherwise the routes of resumable uploads would shadow the
+// files at the root of the store.
+//
+// The content type is detected from the first bytes of the file rather than
+// its extension, which is only used when detection gives a generic type. The
+// file is shown inline by browsers unless the download query parameter is
+// set, types that could run scripts on the origin of the application being
+// shown as plain text. Range requests are supported.
+func serveFile(c echo.Context, conf config) error {
+	p := c.Param("*")
+	if p == "" {
+		p = c.Param("name")
+	}
+
+	p, err := url.PathUnescape(p)
+	if err != nil {
+		return err
+	}
+
+	return serveStoreFile(c, conf, strings.TrimPrefix(path.Clean("/"+p), "/"))
+}
+
+// serveStoreFile sends the file p of the store, p being a cleaned slash
+// separated path
+func serveStoreFile(c echo.Context, conf config, p string) error {
+	// Signed links give access to a single file without credentials
+	if isSignedRequest(c, conf) {
+		if err := checkSignature(conf, p, c.QueryParam("exp"), c.QueryParam("sig")); err != nil {
+			return echo.NewHTTPError(http.StatusForbidden, err.Error())
+		}
+	}
+
+	// Sidecar metadata files hold password hashes, the other internal
+	// files are indexes and partial uploads
+	if isReservedFile(path.Base(p)) {
+		return echo.NotFoundHandler(c)
+	}
+
+	st := storeStorage(conf)
+	fe, err := st.Stat(p)
+	if err != nil {
+		return echo.NotFoundHandler(c)
+	}
+
+	// Redirect directories to a path ending with a slash, on the local
+	// filesystem their index.html page is served like the other files, with
+	// its password and content type rules. Without file index, they are
+	// answered like missing files so that they cannot be probed.
+	if fe.IsDir && conf.NoFileIndex {
+		return echo.NotFoundHandler(c)
+	}
+	if fe.IsDir {
+		u := c.Request().URL.Path
+		if u[len(u)-1] != '/' {
+			return c.Redirect(http.StatusMovedPermanently, u+"/")
+		}
+		if conf.Backend != backendLocal {
+			return echo.NotFoundHandler(c)
+		}
+		p = path.Join(p, "index.html")
+		fe, err = st.Stat(p)
+		if err != nil || fe.IsDir {
+			return echo.NotFoundHandler(c)
+		}
+	}
+
+	if err := checkFilePassword(c, conf, st, p); err != nil {
+		return err
+	}
+
+	f, err := st.Open(p)
+	if err != nil {
+		return echo.NotFoundHandler(c)
+	}
+	defer f.Close()
+
+	ctype, err := detectContentType(f, fe.Name)
+	if err != nil {
+		return err
+	}
+
+	// Count downloads once per client, not for each range requested to
+	// resume or seek
+	if r := c.Request().Header.Get("Range"); c.Request().Method != http.MethodHead && (r == "" || strings.HasPrefix(r, "bytes=0-")) {
+		downloadCounts(conf.StoreDir).increment(p)
+	}
+
+	disposition := "inline"
+	if d := c.QueryParam("download"); d != "" && d != "0" {
+		disposition = "attachment"
+	}
+	if disposition == "inline" && isActiveType(ctype) {
+		ctype = "text/plain; charset=utf-8"
+	}
+
+	h := c.Response().Header()
+	h.Set("X-Content-Type-Options", "nosniff")
+	if !fe.ModTime.IsZero() {
+		h.Set("ETag", fileETag(fe.Size, fe.ModTime))
+	}
+	h.Set(echo.HeaderContentType, ctype)
+	h.Set(echo.HeaderContentDisposition, mime.FormatMediaType(disposition, map[string]string{"filename": fe.Name}))
+
+	// ServeContent answers conditional requests from the ETag and the
+	// modification time
+	http.ServeContent(c.Response(), c.Request(), fe.Name, fe.ModTime, f)
+	return nil
+}
+
+// fileETag returns a validator of the contents of a file computed from its
+// size and modification time
+func fileETag(size int64, modTime time.Time) string {
+	return fmt.Sprintf(`"%x-%x"`, size, modTime.UnixNano())
+}
+
+// staticHandler serves the static files of fsys under the URL path prefix
+// with an ETag. Embedded files have no modification time, their ETag is
+// computed from their contents once.
+func staticHandler(fsys fs.FS, prefix string) http.Handler {
+	var digests sync.Map
+	files := http.StripPrefix(prefix, http.FileServer(http.FS(fsys)))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(path.Clean("/"+strings.TrimPrefix(r.URL.Path, prefix)), "/")
+
+		if fi, err := fs.Stat(fsys, name); err == nil && !fi.IsDir() {
+			if !fi.ModTime().IsZero() {
+				w.Header().Set("ETag", fileETag(fi.Size(), fi.ModTime()))
+			} else if etag, ok := digests.Load(name); ok {
+				w.Header().Set("ETag", etag.(string))
+			} else if data, err := fs.ReadFile(fsys, name); err == nil {
+				etag := fmt.Sprintf(`"%x"`, sha256.Sum256(data))
+				digests.Store(name, etag)
+				w.Header().Set("ETag", etag)
+			}
+		}
+
+		files.ServeHTTP(w, r)
+	})
+}
+
+// Media types of contents browsers run scripts from when shown inline, with
+// the types ending in +xml
+var activeTypes = map[string]bool{
+	"application/ecmascript":   true,
+	"application/javascript":   true,
+	"application/x-javascript": true,
+	"application/xhtml+xml":    true,
+	"application/xml":          true,
+	"text/ecmascript":          true,
+	"text/html":                true,
+	"text/javascript":          true,
+	"text/xml":                 true,
+}
+
+// isActiveType tells if a content type is one browsers could run scripts
+// from, uploaded files of these types would run them on the origin of the
+// application
+func isActiveType(ctype string) bool {
+	mt, _, err := mime.ParseMediaType(ctype)
+	if err != nil {
+		return true
+	}
+	return activeTypes[mt] || strings.HasSuffix(mt, "+xml")
+}
+
+// detectContentType sniffs the content type of a file from its first bytes,
+// falling back to the extension of the file when the detected type is
+// generic. The file is rewound afterwards.
+func detectContentType(f io.ReadSeeker, name string) (string, error) {
+	buf := make([]byte, sniffLen)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	ctype := http.DetectContentType(buf[:n])
+
+	// Types like CSS, JavaScript or SVG are detected as plain text or raw
+	// bytes, the extension gives a better result in those cases
+	if ctype == "application/octet-stream" || strings.HasPrefix(ctype, "text/plain") {
+		if byExt := mime.TypeByExtension(filepath.Ext(name)); byExt != "" {
+			return byExt, nil
+		}
+	}
+
+	return ctype, nil
+}
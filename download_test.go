@@ -0,0 +1,118 @@
+// upl
+//
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDirectoryIndex(t *testing.T) {
+	conf := testConfig(t)
+	ts := testServer(t, conf)
+
+	for _, d := range []string{"site", "private", "empty"} {
+		if err := os.Mkdir(filepath.Join(conf.StoreDir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	page := "<html><script>alert(document.cookie)</script></html>"
+	if err := os.WriteFile(filepath.Join(conf.StoreDir, "site", "index.html"), []byte(page), 0644); err != nil {
+		t.Fatal(err)
+	}
+	protectFile(t, conf, "private/index.html", page, "secret")
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	get := func(p string) *http.Response {
+		res, err := client.Get(ts.URL + p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { res.Body.Close() })
+		return res
+	}
+
+	if res := get("/files/site"); res.StatusCode != http.StatusMovedPermanently {
+		t.Errorf("got status %d without the trailing slash", res.StatusCode)
+	}
+
+	// The page is served like the file, its scripts cannot run
+	res := get("/files/site/")
+	body, _ := io.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK || string(body) != page {
+		t.Errorf("got %d %q", res.StatusCode, body)
+	}
+	if ct := res.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("index served as %s", ct)
+	}
+	if res.Header.Get("X-Content-Type-Options") != "nosniff" {
+		t.Errorf("index served without nosniff")
+	}
+
+	// A protected index requires its password at the URL of the directory
+	if res := get("/files/private/"); res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("got status %d for a protected index", res.StatusCode)
+	}
+	res, err := http.PostForm(ts.URL+"/files/private/", url.Values{passwordField: {"secret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("got status %d with the password", res.StatusCode)
+	}
+
+	if res := get("/files/empty/"); res.StatusCode != http.StatusNotFound {
+		t.Errorf("got status %d for a directory without index", res.StatusCode)
+	}
+}
+
+func TestNoFileIndex(t *testing.T) {
+	conf := testConfig(t)
+	conf.NoFileIndex = true
+	ts := testServer(t, conf)
+
+	if err := os.Mkdir(filepath.Join(conf.StoreDir, "site"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(conf.StoreDir, "site", "index.html"), []byte("<p>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := http.Get(ts.URL + "/files/site/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("got status %d", res.StatusCode)
+	}
+}
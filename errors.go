@@ -0,0 +1,142 @@
+// upl
+//
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/bytes"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// errorHandler returns the HTTP error handler of the application: errors are
+// shown in a page like the others for browsers and as JSON for other clients.
+// Details of unexpected errors are not sent to the client, the request logger
+// shows them.
+func errorHandler(conf config) echo.HTTPErrorHandler {
+	return func(err error, c echo.Context) {
+		if c.Response().Committed {
+			return
+		}
+
+		code := http.StatusInternalServerError
+		msg := http.StatusText(code)
+		if he, ok := err.(*echo.HTTPError); ok {
+			code = he.Code
+			msg = fmt.Sprint(he.Message)
+			if he.Internal != nil && code >= http.StatusInternalServerError {
+				msg = http.StatusText(code)
+			}
+		}
+
+		// The ID of the request is given so that users can report it,
+		// it is also in the header and in the access log
+		id := c.Response().Header().Get(echo.HeaderXRequestID)
+
+		if c.Request().Method == http.MethodHead {
+			err = c.NoContent(code)
+		} else if strings.Contains(c.Request().Header.Get(echo.HeaderAccept), echo.MIMETextHTML) {
+			err = c.Render(code, "error.html", errorView{
+				Root:      conf.RootPath,
+				Title:     conf.Title,
+				Footer:    template.HTML(conf.Footer),
+				Code:      code,
+				Status:    http.StatusText(code),
+				Message:   msg,
+				RequestID: id,
+			})
+		} else {
+			body := map[string]string{"message": msg}
+			if id != "" {
+				body["request_id"] = id
+			}
+			err = c.JSON(code, body)
+		}
+
+		if err != nil {
+			log.Println("could not send error response:", err)
+		}
+	}
+}
+
+// An errorView holds the data used to render the error template
+type errorView struct {
+	Root    string
+	Title   string
+	Footer  template.HTML
+	Code    int
+	Status  string
+	Message string
+	// ID of the failed request, empty when unknown
+	RequestID string
+}
+
+// isFormUpload tells if a request is an upload from the form of the listing
+// page, on the root of a store
+func isFormUpload(c echo.Context) bool {
+	return c.Request().Method == http.MethodPost && strings.HasSuffix(c.Path(), "/")
+}
+
+// formErrors returns a middleware showing the errors of the requests from a
+// form of the listing page back on the page, instead of the error page,
+// for browsers. Unexpected errors still go to the error handler.
+func formErrors(conf config) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			err := next(c)
+			if err == nil || c.Response().Committed || !strings.Contains(c.Request().Header.Get(echo.HeaderAccept), echo.MIMETextHTML) {
+				return err
+			}
+
+			var he *echo.HTTPError
+			if !errors.As(err, &he) || he.Code >= http.StatusInternalServerError {
+				return err
+			}
+
+			// The body limit gives no detail
+			msg := fmt.Sprint(he.Message)
+			if he.Code == http.StatusRequestEntityTooLarge && msg == http.StatusText(he.Code) && conf.MaxUploadSize > 0 {
+				msg = fmt.Sprintf("the upload is too large: maximum is %s", bytes.Format(conf.MaxUploadSize))
+				if conf.MaxFiles > 0 {
+					msg = fmt.Sprintf("the upload is too large: maximum is %d files of %s", conf.MaxFiles, bytes.Format(conf.MaxUploadSize))
+				}
+			}
+
+			// The body may not have been read, the directory of the
+			// listing then comes from the query string only
+			req := c.Request()
+			if req.Form == nil {
+				req.Form = req.URL.Query()
+			}
+
+			return renderListing(c, conf, he.Code, msg)
+		}
+	}
+}
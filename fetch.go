@@ -0,0 +1,256 @@
+// upl
+//
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/bytes"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Number of redirects followed when fetching a URL
+const fetchMaxRedirects = 5
+
+// errForbiddenAddress is returned when connecting to an address of the
+// local host or of a private network while fetching a URL
+var errForbiddenAddress = errors.New("address not allowed")
+
+// Networks not reachable from fetched URLs: loopback, private networks,
+// link-local addresses, including cloud metadata services, and the
+// unspecified, shared and multicast ranges
+var fetchDeniedNets = mustParseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/3",
+	"::/128",
+	"::1/128",
+	"64:ff9b::/96",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+)
+
+// mustParseCIDRs parses networks known to be valid
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+// fetchAllowed tells if a fetched URL can connect to ip. IPv4 addresses
+// mapped to IPv6 are checked as IPv4.
+func fetchAllowed(ip net.IP) bool {
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	for _, n := range fetchDeniedNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// newFetchClient returns the HTTP client fetching URLs. The address is checked
+// when connecting, after name resolution, so that a name cannot resolve to a
+// forbidden address, and for each redirect. Proxies of the environment are
+// not used, they would connect to the address instead.
+func newFetchClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network string, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || !fetchAllowed(ip) {
+				return fmt.Errorf("%s: %w", host, errForbiddenAddress)
+			}
+			return nil
+		},
+	}
+
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: 30 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= fetchMaxRedirects {
+				return fmt.Errorf("stopped after %d redirects", fetchMaxRedirects)
+			}
+			return checkFetchURL(req.URL)
+		},
+	}
+}
+
+// checkFetchURL tells if u can be fetched, only http and https are supported
+func checkFetchURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported scheme: %q", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return fmt.Errorf("missing host in URL")
+	}
+	return nil
+}
+
+// fetchFilename returns the name of a fetched file, from the Content-Disposition
+// header of the response, the last element of the path of the URL or the time
+func fetchFilename(resp *http.Response, start time.Time) string {
+	if cd := resp.Header.Get(echo.HeaderContentDisposition); cd != "" {
+		if _, params, err := mime.ParseMediaType(cd); err == nil && params["filename"] != "" {
+			return params["filename"]
+		}
+	}
+
+	if name := path.Base(resp.Request.URL.Path); name != "." && name != "/" {
+		return name
+	}
+
+	return "fetch-" + start.Format(pasteTimeLayout)
+}
+
+// fetchURL downloads the URL of the url field and stores it like an upload,
+// in the directory of the path field. The download is limited in time and
+// size, and cannot reach the local host or private networks.
+func fetchURL(c echo.Context, conf config) error {
+
+	start := time.Now()
+	defer func() { uploadDuration.Observe(time.Since(start).Seconds()) }()
+
+	u, err := url.Parse(strings.TrimSpace(c.FormValue("url")))
+	if err != nil || c.FormValue("url") == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "missing or invalid url")
+	}
+	if err := checkFetchURL(u); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	st := storeStorage(conf)
+	rel, err := storageDir(st, c.FormValue("path"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+
+	req, err := http.NewRequestWithContext(c.Request().Context(), http.MethodGet, u.String(), nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	req.Header.Set("User-Agent", "upl/"+version)
+
+	resp, err := newFetchClient(conf.FetchTimeout).Do(req)
+	if err != nil {
+		if errors.Is(err, errForbiddenAddress) {
+			return echo.NewHTTPError(http.StatusForbidden, "could not fetch "+u.Redacted()+": "+errForbiddenAddress.Error())
+		}
+		return &echo.HTTPError{
+			Code:     http.StatusBadGateway,
+			Message:  "could not fetch " + u.Redacted(),
+			Internal: err,
+		}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return echo.NewHTTPError(http.StatusBadGateway,
+			fmt.Sprintf("could not fetch %s: %s", u.Redacted(), resp.Status))
+	}
+
+	filename := fetchFilename(resp, start)
+
+	var src io.Reader = resp.Body
+	if conf.MaxUploadSize > 0 {
+		if resp.ContentLength > conf.MaxUploadSize {
+			return echo.NewHTTPError(http.StatusRequestEntityTooLarge,
+				fmt.Sprintf("%s is too large: maximum upload size is %s", filename, bytes.Format(conf.MaxUploadSize)))
+		}
+	}
+
+	// Without the size of the file, the quota is checked once it is
+	// stored
+	sized := resp.ContentLength > 0
+	var reserve int64
+	if sized {
+		reserve = resp.ContentLength
+	}
+	release, err := reserveQuota(conf, reserve)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	rel, err = uploadDir(conf, st, rel, time.Now())
+	if err != nil {
+		return err
+	}
+
+	sf, ok, err := streamFile(conf, st, rel, src, filename, "")
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return echo.NewHTTPError(http.StatusConflict, fmt.Sprintf("file already exists: %s", filename))
+	}
+	if !sized {
+		if err := checkStoredQuota(conf, st, sf.Path); err != nil {
+			return err
+		}
+	}
+	if err := saveUploadMeta(c, conf, st, sf.Path, fileMeta{}, filename); err != nil {
+		return fmt.Errorf("could not save the metadata of %s: %w", sf.Name, err)
+	}
+	audit(c, conf, auditUpload, sf.Path, "", sf.Size)
+	runPostUpload(conf, sf.Path, filename)
+
+	return listFiles(c, conf)
+}
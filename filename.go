@@ -0,0 +1,261 @@
+// upl
+//
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"fmt"
+	"golang.org/x/text/unicode/norm"
+	"mime"
+	"net/textproto"
+	"net/url"
+	"path"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Device names reserved by Windows, they cannot be used as a filename even
+// with an extension
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// sanitizeFilename turns a filename sent by a client into a name safe to
+// create in the store. Only the last element of the path is kept, with both
+// slashes and backslashes as separators, control characters are removed, as
+// well as leading and trailing spaces and trailing dots which are not portable.
+// Empty and reserved names are rejected. Names longer than the maximum length
+// of the configuration are truncated, keeping the extension.
+//
+// Names are normalized to NFC when configured so, because macOS clients send
+// decomposed names that would otherwise look identical to the composed ones
+// sent by other systems while being different files.
+func sanitizeFilename(name string, conf config) (string, error) {
+	clean := path.Base(strings.ReplaceAll(name, "\\", "/"))
+
+	clean = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == unicode.ReplacementChar {
+			return -1
+		}
+		return r
+	}, clean)
+
+	if conf.NormalizeNames {
+		clean = norm.NFC.String(clean)
+	}
+
+	if conf.ASCIINames {
+		clean = transliterate(clean)
+	}
+
+	clean = strings.TrimRight(strings.TrimSpace(clean), ". ")
+	if clean == "" || clean == "/" || strings.Trim(clean, ".") == "" {
+		return "", fmt.Errorf("invalid filename: %q", name)
+	}
+
+	if conf.MaxNameLen > 0 && len(clean) > conf.MaxNameLen {
+		var ok bool
+		if clean, ok = truncateFilename(clean, conf.MaxNameLen); !ok {
+			return "", fmt.Errorf("filename too long: %q", name)
+		}
+	}
+
+	base, _, _ := cut(clean, ".")
+	if reservedNames[strings.ToUpper(strings.TrimSpace(base))] {
+		return "", fmt.Errorf("reserved filename: %q", name)
+	}
+
+	// The indexes, temporary files and sidecars of upl in the store cannot
+	// be replaced by clients
+	if isReservedFile(clean) {
+		return "", fmt.Errorf("reserved filename: %q", name)
+	}
+
+	return clean, nil
+}
+
+// decodeFilename returns the filename of a file of a multipart form in UTF-8,
+// name being the one given by the multipart reader for the part with the
+// header h. The reader decodes the RFC 5987 filename* parameter only when it
+// is in UTF-8, the ISO-8859-1 charset is handled here. Names sent as RFC 2047
+// encoded-words, e.g. =?UTF-8?B?...?=, are decoded too. Buffered forms are
+// parsed by the standard library, which takes a part with only an ISO-8859-1
+// filename* for a field: it is a file only in streamed uploads.
+func decodeFilename(name string, h textproto.MIMEHeader) string {
+	if n, ok := extFilename(h.Get("Content-Disposition")); ok {
+		name = n
+	}
+
+	if strings.Contains(name, "=?") {
+		dec := new(mime.WordDecoder)
+		if n, err := dec.DecodeHeader(name); err == nil {
+			name = n
+		}
+	}
+
+	return name
+}
+
+// extFilename decodes the filename* parameter of a Content-Disposition
+// header when it uses the ISO-8859-1 charset
+func extFilename(disposition string) (string, bool) {
+	for _, param := range strings.Split(disposition, ";") {
+		k, v, ok := cut(strings.TrimSpace(param), "=")
+		if !ok || !strings.EqualFold(strings.TrimSpace(k), "filename*") {
+			continue
+		}
+
+		charset, rest, ok := cut(strings.TrimSpace(v), "'")
+		if !ok || !strings.EqualFold(charset, "iso-8859-1") {
+			return "", false
+		}
+		_, encoded, ok := cut(rest, "'")
+		if !ok {
+			return "", false
+		}
+
+		raw, err := url.PathUnescape(encoded)
+		if err != nil {
+			return "", false
+		}
+
+		// Each byte is the code point of the same value
+		var b strings.Builder
+		for i := 0; i < len(raw); i++ {
+			b.WriteRune(rune(raw[i]))
+		}
+		return b.String(), true
+	}
+
+	return "", false
+}
+
+// truncateFilename shortens name to at most max bytes, which is how
+// filesystems limit the length of names, without splitting a multibyte
+// character. The extension is kept, false is returned when it leaves no room
+// for the rest of the name.
+func truncateFilename(name string, max int) (string, bool) {
+	ext := path.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	room := max - len(ext)
+	if room < 1 {
+		return "", false
+	}
+
+	for len(stem) > room {
+		_, size := utf8.DecodeLastRuneInString(stem)
+		stem = stem[:len(stem)-size]
+	}
+
+	stem = strings.TrimRight(stem, ". ")
+	if stem == "" {
+		return "", false
+	}
+
+	return stem + ext, true
+}
+
+// transliterate replaces accented letters by their base letter and any other
+// non ASCII character by an underscore
+func transliterate(s string) string {
+	var b strings.Builder
+	for _, r := range norm.NFD.String(s) {
+		switch {
+		case unicode.Is(unicode.Mn, r):
+			// Combining marks left by the decomposition
+		case r > unicode.MaxASCII:
+			b.WriteRune('_')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// parseExtList splits a comma separated list of extensions, removing spaces
+// and leading dots and converting them to lowercase
+func parseExtList(s string) []string {
+	exts := make([]string, 0)
+	for _, e := range strings.Split(s, ",") {
+		e = strings.ToLower(strings.TrimLeft(strings.TrimSpace(e), "."))
+		if e != "" {
+			exts = append(exts, e)
+		}
+	}
+	return exts
+}
+
+// fileExtensions returns all the possible extensions of a filename, in
+// lowercase and from the longest: "archive.tar.gz" gives "tar.gz" and "gz".
+// A leading dot does not start an extension, as in ".profile".
+func fileExtensions(name string) []string {
+	name = strings.ToLower(name)
+	exts := make([]string, 0)
+	for i := 1; i < len(name); i++ {
+		if name[i] == '.' && i < len(name)-1 {
+			exts = append(exts, name[i+1:])
+		}
+	}
+	return exts
+}
+
+// checkExtension tells if a sanitized filename can be uploaded according to
+// the configured allowed and denied extensions. Denied extensions take
+// precedence and a file without extension is refused when there is an
+// allowlist.
+func checkExtension(name string, conf config) error {
+	exts := fileExtensions(name)
+
+	for _, e := range exts {
+		for _, d := range conf.DenyExt {
+			if e == d {
+				return fmt.Errorf("extension not allowed: .%s", e)
+			}
+		}
+	}
+
+	if len(conf.AllowExt) == 0 {
+		return nil
+	}
+
+	for _, e := range exts {
+		for _, a := range conf.AllowExt {
+			if e == a {
+				return nil
+			}
+		}
+	}
+
+	if len(exts) == 0 {
+		return fmt.Errorf("files without extension are not allowed: %q", name)
+	}
+
+	return fmt.Errorf("extension not allowed: .%s", exts[len(exts)-1])
+}
@@ -0,0 +1,420 @@
+// upl
+//
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSanitizeFilename(t *testing.T) {
+	conf := newConfig()
+
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"report.pdf", "report.pdf"},
+		{"../../etc/passwd", "passwd"},
+		{"/etc/shadow", "shadow"},
+		{"foo/bar.txt", "bar.txt"},
+		{"foo/", "foo"},
+		{`..\..\windows\win.ini`, "win.ini"},
+		{`C:\Users\me\notes.txt`, "notes.txt"},
+		{"\x00evil\x1b[31m.txt", "evil[31m.txt"},
+		{"tab\tand\nnewline.txt", "tabandnewline.txt"},
+		{"  spaced.txt  ", "spaced.txt"},
+		{"trailing. . .", "trailing"},
+		{"caf\xe9.txt", "caf.txt"},
+		{".hidden", ".hidden"},
+		{"CONFIG.SYS", "CONFIG.SYS"},
+		{"console.log", "console.log"},
+
+		// Rejected names
+		{"", ""},
+		{"   ", ""},
+		{".", ""},
+		{"..", ""},
+		{"...", ""},
+		{"foo/..", ""},
+		{"\x00\x01\x02", ""},
+		{"\u0085\u009b", ""},
+		{"CON", ""},
+		{"con.txt", ""},
+		{"NUL", ""},
+		{"Aux.tar.gz", ""},
+		{"lpt9", ""},
+		{"COM1 .txt", ""},
+		{".upl-dedup.json", ""},
+		{".upl-12345.part", ""},
+		{"dir/.upl-uploads.json", ""},
+		{".report.pdf.upl.json", ""},
+		{".report.pdf.part", ""},
+	}
+
+	for _, tt := range tests {
+		got, err := sanitizeFilename(tt.in, conf)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("sanitizeFilename(%q) = %q, want an error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("sanitizeFilename(%q) = %q, %v, want %q", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestSanitizeFilenameASCII(t *testing.T) {
+	conf := newConfig()
+	conf.ASCIINames = true
+
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"Résumé.pdf", "Resume.pdf"},
+		{"naïve café.txt", "naive cafe.txt"},
+		{"日本.txt", "__.txt"},
+	}
+
+	for _, tt := range tests {
+		got, err := sanitizeFilename(tt.in, conf)
+		if err != nil || got != tt.want {
+			t.Errorf("sanitizeFilename(%q) = %q, %v, want %q", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestSanitizeFilenameNFC(t *testing.T) {
+	tests := []struct {
+		in        string
+		normalize bool
+		want      string
+	}{
+		// Decomposed names sent by macOS
+		{"Ame\u0301lie.txt", true, "Am\u00e9lie.txt"},
+		{"Ame\u0301lie.txt", false, "Ame\u0301lie.txt"},
+		{"Am\u00e9lie.txt", true, "Am\u00e9lie.txt"},
+		{"n\u0303o\u0308 \u212b.txt", true, "\u00f1\u00f6 \u00c5.txt"},
+
+		// Emoji are kept as is, with their joiners and variation selectors
+		{"\U0001f4f7 photo.jpg", true, "\U0001f4f7 photo.jpg"},
+		{"\U0001f469\u200d\U0001f4bb\ufe0f.png", true, "\U0001f469\u200d\U0001f4bb\ufe0f.png"},
+		{"\U0001f1eb\U0001f1f7 cafe\u0301 \U0001f950.txt", true, "\U0001f1eb\U0001f1f7 caf\u00e9 \U0001f950.txt"},
+	}
+
+	for _, tt := range tests {
+		conf := newConfig()
+		conf.NormalizeNames = tt.normalize
+		got, err := sanitizeFilename(tt.in, conf)
+		if err != nil || got != tt.want {
+			t.Errorf("sanitizeFilename(%+q, normalize=%v) = %+q, %v, want %+q", tt.in, tt.normalize, got, err, tt.want)
+		}
+	}
+}
+
+func TestUploadNFCRoundTrip(t *testing.T) {
+	conf := testConfig(t)
+	ts := testServer(t, conf)
+
+	composed := "\U0001f4f7 Am\u00e9lie.txt"
+	for _, name := range []string{"\U0001f4f7 Ame\u0301lie.txt", composed} {
+		res := postFiles(t, ts.URL+"/api/upload", conf.UploadField, []testPart{{filename: name, data: name}}, nil)
+		if res.StatusCode != http.StatusCreated {
+			t.Fatalf("upload of %+q: got status %d", name, res.StatusCode)
+		}
+	}
+
+	// Both uploads are the same file, listed once under the composed name
+	res, err := http.Get(ts.URL + "/api/files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var files []fileEntry
+	if err := json.NewDecoder(res.Body).Decode(&files); err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name != composed {
+		t.Fatalf("got listing %+v, want a single %+q", files, composed)
+	}
+
+	res, err = http.Get(ts.URL + "/files/" + url.PathEscape(composed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK || string(body) != composed {
+		t.Errorf("download of %+q: got %d %+q", composed, res.StatusCode, body)
+	}
+}
+
+func TestFileExtensions(t *testing.T) {
+	tests := []struct {
+		name string
+		want []string
+	}{
+		{"archive.tar.gz", []string{"tar.gz", "gz"}},
+		{"Backup.TAR.GZ", []string{"tar.gz", "gz"}},
+		{"photo.jpg", []string{"jpg"}},
+		{"README", []string{}},
+		{".profile", []string{}},
+		{".config.tar.gz", []string{"tar.gz", "gz"}},
+		{"trailing.", []string{}},
+	}
+
+	for _, tt := range tests {
+		if got := fileExtensions(tt.name); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("fileExtensions(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCheckExtension(t *testing.T) {
+	tests := []struct {
+		allow string
+		deny  string
+		name  string
+		err   string
+	}{
+		{"", "", "anything.exe", ""},
+		{"", "exe,.BAT", "setup.exe", ".exe"},
+		{"", "exe,.BAT", "SETUP.EXE", ".exe"},
+		{"", "exe,.BAT", "run.bat", ".bat"},
+		{"", "exe", "README", ""},
+
+		// Double extensions match as a whole or by their last part
+		{"tar.gz", "", "archive.tar.gz", ""},
+		{"tar.gz", "", "archive.TAR.GZ", ""},
+		{"tar.gz", "", "archive.gz", ".gz"},
+		{"tar.gz", "", "archive.tar", ".tar"},
+		{"gz", "", "archive.tar.gz", ""},
+		{"gz", "tar.gz", "archive.tar.gz", ".tar.gz"},
+		{"tar.gz", "gz", "archive.tar.gz", ".gz"},
+		{"pdf", "", "evil.pdf.exe", ".exe"},
+		{"pdf", "exe", "evil.exe.pdf", ""},
+
+		// Deny takes precedence and no extension fails an allowlist
+		{"txt", "txt", "notes.txt", ".txt"},
+		{"txt", "", "README", "without extension"},
+		{"txt", "", ".txt", "without extension"},
+	}
+
+	for _, tt := range tests {
+		conf := newConfig()
+		conf.AllowExt = parseExtList(tt.allow)
+		conf.DenyExt = parseExtList(tt.deny)
+
+		err := checkExtension(tt.name, conf)
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("allow=%q deny=%q %q: got error %v", tt.allow, tt.deny, tt.name, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("allow=%q deny=%q %q: got error %v, want %q", tt.allow, tt.deny, tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestUploadDeniedExtension(t *testing.T) {
+	conf := testConfig(t)
+	conf.DenyExt = parseExtList("tar.gz")
+	ts := testServer(t, conf)
+
+	res := postFiles(t, ts.URL+"/api/upload", conf.UploadField, []testPart{{filename: "backup.tar.gz", data: "x"}}, nil)
+	body, _ := io.ReadAll(res.Body)
+	if res.StatusCode != http.StatusBadRequest || !strings.Contains(string(body), ".tar.gz") {
+		t.Errorf("got %d %s", res.StatusCode, body)
+	}
+
+	res = postFiles(t, ts.URL+"/api/upload", conf.UploadField, []testPart{{filename: "backup.gz", data: "x"}}, nil)
+	if res.StatusCode != http.StatusCreated {
+		t.Errorf("got %d for an allowed extension", res.StatusCode)
+	}
+}
+
+func TestTruncateFilename(t *testing.T) {
+	tests := []struct {
+		name string
+		max  int
+		want string
+	}{
+		{"short.txt", 255, "short.txt"},
+		{"abcdef.txt", 9, "abcde.txt"},
+
+		// Multibyte characters are never cut in the middle
+		{"\u00e9\u00e9\u00e9.txt", 9, "\u00e9\u00e9.txt"},
+		{"\u00e9\u00e9\u00e9.txt", 8, "\u00e9\u00e9.txt"},
+		{"\u00e9\u00e9\u00e9.txt", 7, "\u00e9.txt"},
+		{"\u65e5\u672c\u8a9e.txt", 10, "\u65e5\u672c.txt"},
+		{"\u65e5\u672c\u8a9e.txt", 9, "\u65e5.txt"},
+		{"\U0001f4f7\U0001f4f7.jpg", 11, "\U0001f4f7.jpg"},
+		{"\U0001f4f7\U0001f4f7.jpg", 7, ""},
+
+		// Nothing is left of the stem, or the extension does not fit
+		{"abc.txt", 4, ""},
+		{"a.verylongextension", 10, ""},
+		{"a  b.txt", 7, "a.txt"},
+	}
+
+	for _, tt := range tests {
+		got, ok := truncateFilename(tt.name, tt.max)
+		if tt.want == "" {
+			if ok {
+				t.Errorf("truncateFilename(%+q, %d) = %+q, want a failure", tt.name, tt.max, got)
+			}
+			continue
+		}
+		if !ok || got != tt.want {
+			t.Errorf("truncateFilename(%+q, %d) = %+q, %v, want %+q", tt.name, tt.max, got, ok, tt.want)
+		}
+	}
+}
+
+func TestSanitizeFilenameMaxLen(t *testing.T) {
+	conf := newConfig()
+
+	// Two bytes characters around the limit of 255 bytes
+	for n := 124; n <= 128; n++ {
+		name := strings.Repeat("\u00e9", n) + ".tar.gz"
+		got, err := sanitizeFilename(name, conf)
+		if err != nil {
+			t.Errorf("%d bytes: %v", len(name), err)
+			continue
+		}
+		if len(got) > conf.MaxNameLen || !utf8.ValidString(got) || !strings.HasSuffix(got, ".gz") {
+			t.Errorf("%d bytes: got %d bytes %+q", len(name), len(got), got)
+		}
+		if len(name) <= conf.MaxNameLen && got != name {
+			t.Errorf("%d bytes: truncated to %+q", len(name), got)
+		}
+	}
+
+	// Three and four bytes characters
+	for _, c := range []string{"\u65e5", "\U0001f600"} {
+		name := strings.Repeat(c, 300) + ".txt"
+		got, err := sanitizeFilename(name, conf)
+		if err != nil || len(got) > conf.MaxNameLen || len(got) < conf.MaxNameLen-len(c)+1 || !utf8.ValidString(got) {
+			t.Errorf("%+q: got %d bytes, %v", c, len(got), err)
+		}
+	}
+
+	if _, err := sanitizeFilename("a."+strings.Repeat("x", 300), conf); err == nil {
+		t.Errorf("name with an extension longer than the maximum accepted")
+	}
+
+	conf.MaxNameLen = 0
+	long := strings.Repeat("x", 1000) + ".txt"
+	if got, err := sanitizeFilename(long, conf); err != nil || got != long {
+		t.Errorf("name truncated without a maximum length")
+	}
+}
+
+// Content-Disposition headers of file parts with encoded filenames and the
+// decoded names
+var encodedFilenames = []struct {
+	disposition string
+	want        string
+}{
+	{`form-data; name="upload"; filename="plain.txt"`, "plain.txt"},
+
+	// RFC 5987 extended parameters
+	{`form-data; name="upload"; filename*=UTF-8''%E2%82%AC%20rates.txt`, "\u20ac rates.txt"},
+	{`form-data; name="upload"; filename*=utf-8'en'%C3%A9t%C3%A9.txt`, "\u00e9t\u00e9.txt"},
+	{`form-data; name="upload"; filename*=ISO-8859-1''caf%E9.txt`, "caf\u00e9.txt"},
+	{`form-data; name="upload"; filename*=iso-8859-1'fr'%C9t%E9.txt`, "\u00c9t\u00e9.txt"},
+	{`form-data; name="upload"; filename="fallback.txt"; filename*=UTF-8''na%C3%AFve.txt`, "na\u00efve.txt"},
+	{`form-data; name="upload"; filename="fallback.txt"; filename*=ISO-8859-1''na%EFve.txt`, "na\u00efve.txt"},
+
+	// RFC 2047 encoded-words
+	{`form-data; name="upload"; filename="=?UTF-8?B?w6ljb2xlLnR4dA==?="`, "\u00e9cole.txt"},
+	{`form-data; name="upload"; filename="=?utf-8?q?caf=C3=A9_cr=C3=A8me.txt?="`, "caf\u00e9 cr\u00e8me.txt"},
+	{`form-data; name="upload"; filename="=?ISO-8859-1?B?culzdW3pLnBkZg==?="`, "r\u00e9sum\u00e9.pdf"},
+	{`form-data; name="upload"; filename="=?UTF-8?B?w6k=?= =?UTF-8?B?w6k=?=.txt"`, "\u00e9\u00e9.txt"},
+
+	// Invalid encodings are kept as sent
+	{`form-data; name="upload"; filename="=?UTF-8?X?bad?=.txt"`, "=?UTF-8?X?bad?=.txt"},
+}
+
+func TestDecodeFilename(t *testing.T) {
+	for _, tt := range encodedFilenames {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		h := make(map[string][]string)
+		h["Content-Disposition"] = []string{tt.disposition}
+		w, err := mw.CreatePart(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(w, "x")
+		mw.Close()
+
+		part, err := multipart.NewReader(&body, mw.Boundary()).NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := decodeFilename(part.FileName(), part.Header); got != tt.want {
+			t.Errorf("%s: got %+q, want %+q", tt.disposition, got, tt.want)
+		}
+	}
+}
+
+func TestUploadEncodedFilename(t *testing.T) {
+	for _, stream := range []bool{false, true} {
+		conf := testConfig(t)
+		conf.StreamUploads = stream
+		ts := testServer(t, conf)
+
+		for _, tt := range encodedFilenames[1:] {
+			// Buffered forms take a part with only an ISO-8859-1
+			// filename* for a field
+			isoOnly := strings.Contains(strings.ToLower(tt.disposition), "filename*=iso-8859-1") &&
+				!strings.Contains(tt.disposition, `filename="`)
+			if !stream && isoOnly {
+				continue
+			}
+			parts := []testPart{{data: tt.want, header: map[string]string{"Content-Disposition": tt.disposition}}}
+			res := postFiles(t, ts.URL+"/api/upload", conf.UploadField, parts, nil)
+			if res.StatusCode != http.StatusCreated {
+				t.Errorf("stream=%v %s: got status %d", stream, tt.disposition, res.StatusCode)
+				continue
+			}
+			if got := readStoreFile(t, conf, tt.want); got != tt.want {
+				t.Errorf("stream=%v: %+q not stored", stream, tt.want)
+			}
+		}
+	}
+}
@@ -2,4 +2,16 @@ module github.com/orgrim/upl
 
 go 1.16
 
-require github.com/labstack/echo/v4 v4.2.2
+require (
+	github.com/labstack/echo/v4 v4.2.2
+	github.com/labstack/gommon v0.3.0
+	github.com/minio/minio-go/v7 v7.0.12
+	github.com/prometheus/client_golang v1.11.1
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
+	github.com/yuin/goldmark v1.4.13
+	golang.org/x/crypto v0.0.0-20201216223049-8b5274cf687f
+	golang.org/x/image v0.0.0-20210628002857-a66eb6448b8d
+	golang.org/x/net v0.0.0-20200822124328-c89045814202
+	golang.org/x/text v0.3.6
+	golang.org/x/time v0.0.0-20201208040808-7e3f01d25324
+)
@@ -0,0 +1,91 @@
+// upl
+//
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// parseIgnore splits a comma separated list of glob patterns matching the
+// names of the entries to leave out of the listing
+func parseIgnore(s string) ([]string, error) {
+	patterns := make([]string, 0)
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("%s: %w", p, err)
+		}
+		patterns = append(patterns, p)
+	}
+
+	return patterns, nil
+}
+
+// isInternalFile tells if a name is the one of a file of upl in the store:
+// indexes, temporary files of uploads and parts of resumable uploads
+func isInternalFile(name string) bool {
+	return strings.HasPrefix(name, ".upl-") || (strings.HasPrefix(name, ".") && strings.HasSuffix(name, ".part"))
+}
+
+// isReservedFile tells if a name is the one of an internal file or of a
+// sidecar, which clients can neither upload, modify nor download
+func isReservedFile(name string) bool {
+	return isInternalFile(name) || isMetaFile(name)
+}
+
+// isIgnored tells if an entry is left out of the listing because it is
+// internal, a dotfile or matched by one of the ignore patterns
+func isIgnored(name string, conf config) bool {
+	if isInternalFile(name) {
+		return true
+	}
+	if conf.HideDotfiles && strings.HasPrefix(name, ".") {
+		return true
+	}
+	for _, p := range conf.Ignore {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// hideEntries removes the ignored entries from the files of a directory
+func hideEntries(files []fileEntry, conf config) []fileEntry {
+	kept := files[:0]
+	for _, f := range files {
+		if !isIgnored(f.Name, conf) {
+			kept = append(kept, f)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,142 @@
+// upl
+//
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseIgnore(t *testing.T) {
+	got, err := parseIgnore(" *.bak, ,~*,Thumbs.db ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"*.bak", "~*", "Thumbs.db"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if got, err := parseIgnore(""); err != nil || len(got) != 0 {
+		t.Errorf("got %q, %v for an empty list", got, err)
+	}
+
+	for _, bad := range []string{"[", "*.bak,[a-", `a\`} {
+		if _, err := parseIgnore(bad); err == nil {
+			t.Errorf("invalid pattern %q accepted", bad)
+		}
+	}
+}
+
+func TestIsIgnored(t *testing.T) {
+	patterns, err := parseIgnore("*.bak,~*,Thumbs.db,tmp?,[abc].log,*.[oa]")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		dots bool
+		want bool
+	}{
+		{"report.pdf", true, false},
+		{"report.bak", true, true},
+		{"report.bak.pdf", true, false},
+		{"~lock.docx", true, true},
+		{"Thumbs.db", true, true},
+		{"thumbs.db", true, false},
+		{"tmp1", true, true},
+		{"tmp12", true, false},
+		{"a.log", true, true},
+		{"d.log", true, false},
+		{"main.o", true, true},
+		{"lib.a", true, true},
+		{"lib.so", true, false},
+
+		// Dotfiles depend on the option, the files of upl are always
+		// hidden
+		{".profile", true, true},
+		{".profile", false, false},
+		{".upl-dedup.json", false, true},
+		{".upl-3141.part", false, true},
+		{".report.pdf.part", false, true},
+	}
+
+	for _, tt := range tests {
+		conf := newConfig()
+		conf.HideDotfiles = tt.dots
+		conf.Ignore = patterns
+		if got := isIgnored(tt.name, conf); got != tt.want {
+			t.Errorf("isIgnored(%q, dotfiles=%v) = %v, want %v", tt.name, tt.dots, got, tt.want)
+		}
+	}
+}
+
+func TestListingIgnore(t *testing.T) {
+	conf := testConfig(t)
+	conf.Ignore = []string{"*.bak"}
+	ts := testServer(t, conf)
+
+	for _, name := range []string{"kept.txt", "old.bak", ".hidden", ".upl-1.part"} {
+		if err := os.WriteFile(filepath.Join(conf.StoreDir, name), []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The JSON and HTML listings show the same entries
+	res, err := http.Get(ts.URL + "/api/files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var files []fileEntry
+	if err := json.NewDecoder(res.Body).Decode(&files); err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name != "kept.txt" {
+		t.Errorf("got JSON listing %+v", files)
+	}
+
+	res, err = http.Get(ts.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	for _, name := range []string{"old.bak", ".hidden", ".upl-1.part"} {
+		if strings.Contains(string(body), name) {
+			t.Errorf("%s in the HTML listing", name)
+		}
+	}
+	if !strings.Contains(string(body), "kept.txt") {
+		t.Errorf("kept.txt missing from the HTML listing")
+	}
+}
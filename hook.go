@@ -0,0 +1,80 @@
+// upl
+//
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// runPostUpload starts the post-upload command of the configuration on the
+// file p of the store, in the background, when one is set. The command is
+// executed directly, without a shell, with the path of the file on the local
+// filesystem as its argument. The name given by the client is passed in the
+// UPL_FILENAME environment variable, the path relative to the store in
+// UPL_PATH and the name of the store in UPL_STORE.
+func runPostUpload(conf config, p string, original string) {
+	if conf.PostUploadCmd == "" {
+		return
+	}
+
+	filename, err := filepath.Abs(filepath.Join(conf.StoreDir, filepath.FromSlash(p)))
+	if err != nil {
+		log.Printf("could not run post-upload command on %s: %s\n", p, err)
+		return
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), conf.PostUploadTimeout)
+		defer cancel()
+
+		cmd := exec.CommandContext(ctx, conf.PostUploadCmd, filename)
+		cmd.Env = append(os.Environ(),
+			"UPL_FILENAME="+original,
+			"UPL_PATH="+p,
+			"UPL_STORE="+conf.StoreName,
+		)
+
+		out, err := cmd.CombinedOutput()
+		if ctx.Err() == context.DeadlineExceeded {
+			log.Printf("post-upload command on %s timed out after %s\n", p, conf.PostUploadTimeout)
+			return
+		}
+		if err != nil {
+			if msg := strings.TrimSpace(string(out)); msg != "" {
+				err = fmt.Errorf("%w: %s", err, msg)
+			}
+			log.Printf("post-upload command on %s failed: %s\n", p, err)
+			return
+		}
+		log.Printf("post-upload command on %s exited with status 0\n", p)
+	}()
+}
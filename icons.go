@@ -0,0 +1,116 @@
+// upl
+//
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"path"
+	"strings"
+)
+
+// Font Awesome class of the icon shown for files without a more specific one
+const defaultIcon = "fa-file-o"
+
+// Font Awesome classes of the icons of files by extension
+var iconExts = map[string]string{
+	// Archives
+	".7z":  "fa-file-archive-o",
+	".bz2": "fa-file-archive-o",
+	".gz":  "fa-file-archive-o",
+	".rar": "fa-file-archive-o",
+	".tar": "fa-file-archive-o",
+	".tgz": "fa-file-archive-o",
+	".xz":  "fa-file-archive-o",
+	".zip": "fa-file-archive-o",
+	".zst": "fa-file-archive-o",
+	// Images
+	".bmp":  "fa-file-image-o",
+	".gif":  "fa-file-image-o",
+	".heic": "fa-file-image-o",
+	".jpeg": "fa-file-image-o",
+	".jpg":  "fa-file-image-o",
+	".png":  "fa-file-image-o",
+	".svg":  "fa-file-image-o",
+	".tif":  "fa-file-image-o",
+	".tiff": "fa-file-image-o",
+	".webp": "fa-file-image-o",
+	// Audio and video
+	".flac": "fa-file-audio-o",
+	".m4a":  "fa-file-audio-o",
+	".mp3":  "fa-file-audio-o",
+	".ogg":  "fa-file-audio-o",
+	".opus": "fa-file-audio-o",
+	".wav":  "fa-file-audio-o",
+	".avi":  "fa-file-video-o",
+	".mkv":  "fa-file-video-o",
+	".mov":  "fa-file-video-o",
+	".mp4":  "fa-file-video-o",
+	".webm": "fa-file-video-o",
+	// Documents
+	".pdf":  "fa-file-pdf-o",
+	".doc":  "fa-file-word-o",
+	".docx": "fa-file-word-o",
+	".odt":  "fa-file-word-o",
+	".rtf":  "fa-file-word-o",
+	".ods":  "fa-file-excel-o",
+	".xls":  "fa-file-excel-o",
+	".xlsx": "fa-file-excel-o",
+	".odp":  "fa-file-powerpoint-o",
+	".ppt":  "fa-file-powerpoint-o",
+	".pptx": "fa-file-powerpoint-o",
+	".csv":  "fa-file-text-o",
+	".log":  "fa-file-text-o",
+	".md":   "fa-file-text-o",
+	".txt":  "fa-file-text-o",
+	// Code
+	".c":    "fa-file-code-o",
+	".css":  "fa-file-code-o",
+	".go":   "fa-file-code-o",
+	".h":    "fa-file-code-o",
+	".html": "fa-file-code-o",
+	".java": "fa-file-code-o",
+	".js":   "fa-file-code-o",
+	".json": "fa-file-code-o",
+	".py":   "fa-file-code-o",
+	".rs":   "fa-file-code-o",
+	".sh":   "fa-file-code-o",
+	".sql":  "fa-file-code-o",
+	".ts":   "fa-file-code-o",
+	".xml":  "fa-file-code-o",
+	".yaml": "fa-file-code-o",
+	".yml":  "fa-file-code-o",
+}
+
+// Icon returns the Font Awesome class of the icon of the entry, from the
+// extension of its name
+func (f fileEntry) Icon() string {
+	if f.IsDir {
+		return "fa-folder"
+	}
+	if icon, ok := iconExts[strings.ToLower(path.Ext(f.Name))]; ok {
+		return icon
+	}
+	return defaultIcon
+}
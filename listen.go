@@ -0,0 +1,190 @@
+// upl
+//
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// Prefix of the listen address of a Unix domain socket
+const socketPrefix = "unix:"
+
+// A listenFlag collects the values of the repeatable -listen option
+type listenFlag struct {
+	values []string
+	set    bool
+}
+
+func (f *listenFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return strings.Join(f.values, ",")
+}
+
+// Set adds an address, the first call replaces the default
+func (f *listenFlag) Set(v string) error {
+	if !f.set {
+		f.values = nil
+		f.set = true
+	}
+	f.values = append(f.values, v)
+	return nil
+}
+
+// Reset forgets the values set so far, when a layer of the configuration
+// overrides a previous one
+func (f *listenFlag) Reset() {
+	f.set = false
+}
+
+// apply checks the addresses and sets them in the configuration, host:port
+// addresses being normalized
+func (f *listenFlag) apply(c *config, ipv6Only bool) error {
+	seen := make(map[string]bool, len(f.values))
+	c.Listen = nil
+	for _, v := range f.values {
+		if strings.HasPrefix(v, socketPrefix) {
+			if v == socketPrefix {
+				return fmt.Errorf("missing socket path")
+			}
+		} else {
+			h, p, err := parseListenAddr(v, ipv6Only)
+			if err != nil {
+				return err
+			}
+			v = net.JoinHostPort(h, p)
+		}
+
+		if seen[v] {
+			return fmt.Errorf("%s: duplicate address", v)
+		}
+		seen[v] = true
+		c.Listen = append(c.Listen, v)
+	}
+
+	return nil
+}
+
+// hasSocket tells if one of the listen addresses is a Unix domain socket
+func (c config) hasSocket() bool {
+	for _, a := range c.Listen {
+		if strings.HasPrefix(a, socketPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// tlsPort returns the port of the first TCP listen address, where plain HTTP
+// requests are redirected
+func (c config) tlsPort() string {
+	for _, a := range c.Listen {
+		if _, p, err := net.SplitHostPort(a); err == nil {
+			return p
+		}
+	}
+	return ""
+}
+
+// openListeners binds all the listen addresses of the configuration. When
+// one of them fails, the ones already open are closed.
+func openListeners(c config) ([]net.Listener, error) {
+	network := "tcp"
+	if c.IPv6Only {
+		network = "tcp6"
+	}
+
+	listeners := make([]net.Listener, 0, len(c.Listen))
+	for _, a := range c.Listen {
+		var (
+			l   net.Listener
+			err error
+		)
+		if strings.HasPrefix(a, socketPrefix) {
+			l, err = listenUnix(strings.TrimPrefix(a, socketPrefix), c.SocketPerm)
+		} else {
+			l, err = net.Listen(network, a)
+		}
+		if err != nil {
+			for _, o := range listeners {
+				o.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+
+	return listeners, nil
+}
+
+// listenUnix creates the listener of a Unix domain socket. A stale socket
+// left by a previous run is removed first, but not other kinds of files.
+func listenUnix(socketPath string, perm os.FileMode) (net.Listener, error) {
+	if fi, err := os.Lstat(socketPath); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", socketPath)
+		}
+		if err := os.Remove(socketPath); err != nil {
+			return nil, err
+		}
+	}
+
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(socketPath, perm); err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// parseListenAddr splits a host:port listen address, the host being an IPv6
+// literal in brackets, a name, an IP address or empty to listen on all
+// addresses. With ipv6Only, IPv4 addresses are refused.
+func parseListenAddr(hostPort string, ipv6Only bool) (string, string, error) {
+	h, p, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return "", "", err
+	}
+
+	if _, err := net.LookupPort("tcp", p); err != nil {
+		return "", "", fmt.Errorf("invalid port: %s", p)
+	}
+
+	if ip := net.ParseIP(h); ip != nil && ip.To4() != nil && ipv6Only {
+		return "", "", fmt.Errorf("%s is not an IPv6 address", h)
+	}
+
+	return h, p, nil
+}
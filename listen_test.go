@@ -0,0 +1,118 @@
+// upl
+//
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestParseListenAddr(t *testing.T) {
+	tests := []struct {
+		addr     string
+		ipv6Only bool
+		host     string
+		port     string
+		ok       bool
+	}{
+		{"[::1]:1323", false, "::1", "1323", true},
+		{"[::1]:1323", true, "::1", "1323", true},
+		{"[::]:1323", false, "::", "1323", true},
+		{"[fe80::1%eth0]:1323", false, "fe80::1%eth0", "1323", true},
+		{":1323", false, "", "1323", true},
+		{":1323", true, "", "1323", true},
+		{"localhost:1323", false, "localhost", "1323", true},
+		{"localhost:1323", true, "localhost", "1323", true},
+		{"127.0.0.1:1323", false, "127.0.0.1", "1323", true},
+		{"0.0.0.0:http", false, "0.0.0.0", "http", true},
+
+		{"127.0.0.1:1323", true, "", "", false},
+		{"0.0.0.0:1323", true, "", "", false},
+		{"::1:1323", false, "", "", false},
+		{"[::1]", false, "", "", false},
+		{"localhost", false, "", "", false},
+		{":99999", false, "", "", false},
+		{":nope", false, "", "", false},
+	}
+
+	for _, tt := range tests {
+		h, p, err := parseListenAddr(tt.addr, tt.ipv6Only)
+		if (err == nil) != tt.ok {
+			t.Errorf("parseListenAddr(%q, %v): got error %v", tt.addr, tt.ipv6Only, err)
+			continue
+		}
+		if h != tt.host || p != tt.port {
+			t.Errorf("parseListenAddr(%q, %v) = %q, %q, want %q, %q", tt.addr, tt.ipv6Only, h, p, tt.host, tt.port)
+		}
+	}
+}
+
+func TestListenFlag(t *testing.T) {
+	var f listenFlag
+	for _, v := range []string{"[::1]:1323", ":1323", "localhost:1323", "unix:/run/upl.sock"} {
+		f.Set(v)
+	}
+
+	var c config
+	if err := f.apply(&c, false); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"[::1]:1323", ":1323", "localhost:1323", "unix:/run/upl.sock"}
+	if !reflect.DeepEqual(c.Listen, want) {
+		t.Errorf("got %q, want %q", c.Listen, want)
+	}
+	if !c.hasSocket() || c.tlsPort() != "1323" {
+		t.Errorf("hasSocket() = %v, tlsPort() = %q", c.hasSocket(), c.tlsPort())
+	}
+
+	f.Set("[::1]:1323")
+	if err := f.apply(&c, false); err == nil {
+		t.Errorf("duplicate [::1]:1323 accepted")
+	}
+}
+
+func TestOpenListenersIPv6(t *testing.T) {
+	if l, err := net.Listen("tcp6", "[::1]:0"); err != nil {
+		t.Skip("no IPv6 loopback:", err)
+	} else {
+		l.Close()
+	}
+
+	for _, ipv6Only := range []bool{false, true} {
+		c := config{Listen: []string{"[::1]:0"}, IPv6Only: ipv6Only}
+		ls, err := openListeners(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, l := range ls {
+			if ip := l.Addr().(*net.TCPAddr).IP; !ip.Equal(net.IPv6loopback) {
+				t.Errorf("ipv6Only=%v: listening on %s", ipv6Only, l.Addr())
+			}
+			l.Close()
+		}
+	}
+}
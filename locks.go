@@ -0,0 +1,52 @@
+// upl
+//
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// Number of mutexes shared by the names of the uploaded files
+const nameLockShards = 64
+
+// Locks serializing the uploads of the same file name, so that the conflict
+// strategy sees the files stored by concurrent uploads
+var nameLocks [nameLockShards]sync.Mutex
+
+// lockName locks the file p of the store, a slash separated path relative to
+// its directory, and returns the function to unlock it. Distinct names may
+// share a lock.
+func lockName(storeDir string, p string) func() {
+	h := fnv.New32a()
+	h.Write([]byte(storeDir))
+	h.Write([]byte{0})
+	h.Write([]byte(p))
+
+	m := &nameLocks[h.Sum32()%nameLockShards]
+	m.Lock()
+	return m.Unlock
+}
@@ -0,0 +1,146 @@
+// upl
+//
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+)
+
+// storeConcurrently stores n files of distinct contents under the same name
+// at the same time, it returns the contents of the stored ones and the number
+// of rejected ones
+func storeConcurrently(t *testing.T, conf config, name string, n int) ([]string, int) {
+	t.Helper()
+
+	st := storeStorage(conf)
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		stored   []string
+		rejected int
+		errs     []error
+	)
+
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			// Large contents read by small chunks keep the writes
+			// of the uploads interleaved
+			data := strings.Repeat(fmt.Sprintf("upload %03d\n", i), 2000)
+			src := iotest.HalfReader(strings.NewReader(data))
+
+			_, ok, err := storeFile(conf, st, "", name, src, -1)
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err != nil:
+				errs = append(errs, err)
+			case !ok:
+				rejected++
+			default:
+				stored = append(stored, data)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		t.Error(err)
+	}
+	return stored, rejected
+}
+
+// isUploadContents tells if data is intact contents of storeConcurrently
+func isUploadContents(data string) bool {
+	line, _, _ := cut(data, "\n")
+	return len(data) > 0 && data == strings.Repeat(line+"\n", 2000) && strings.HasPrefix(line, "upload ")
+}
+
+func TestConcurrentUploadsOverwrite(t *testing.T) {
+	conf := testConfig(t)
+	storeConcurrently(t, conf, "data.csv", 20)
+
+	if got := readStoreFile(t, conf, "data.csv"); !isUploadContents(got) {
+		t.Errorf("corrupted file of %d bytes", len(got))
+	}
+	if names := storeEntries(t, conf); len(names) != 1 {
+		t.Errorf("got entries %v", names)
+	}
+}
+
+func TestConcurrentUploadsRename(t *testing.T) {
+	conf := testConfig(t)
+	conf.OnConflict = conflictRename
+	n := 20
+	stored, _ := storeConcurrently(t, conf, "data.csv", n)
+	if len(stored) != n {
+		t.Fatalf("stored %d files, want %d", len(stored), n)
+	}
+
+	// Each upload got its own name and every file is one of them, intact
+	want := []string{"data.csv"}
+	for i := 1; i < n; i++ {
+		want = append(want, fmt.Sprintf("data (%d).csv", i))
+	}
+	names := storeEntries(t, conf)
+	sort.Strings(names)
+	sort.Strings(want)
+	if strings.Join(names, "|") != strings.Join(want, "|") {
+		t.Fatalf("got entries %q, want %q", names, want)
+	}
+
+	seen := make(map[string]bool)
+	for _, name := range names {
+		data := readStoreFile(t, conf, name)
+		if !isUploadContents(data) {
+			t.Errorf("%s: corrupted file of %d bytes", name, len(data))
+		}
+		if seen[data] {
+			t.Errorf("%s: contents stored twice", name)
+		}
+		seen[data] = true
+	}
+}
+
+func TestConcurrentUploadsReject(t *testing.T) {
+	conf := testConfig(t)
+	conf.OnConflict = conflictReject
+	stored, rejected := storeConcurrently(t, conf, "data.csv", 20)
+
+	if len(stored) != 1 || rejected != 19 {
+		t.Fatalf("stored %d files and rejected %d", len(stored), rejected)
+	}
+	if got := readStoreFile(t, conf, "data.csv"); got != stored[0] {
+		t.Errorf("the stored file is not the accepted upload")
+	}
+}
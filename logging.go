@@ -0,0 +1,80 @@
+// upl
+//
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+	"time"
+)
+
+// Formats of the logs
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// Where requests are logged, the output of echo when nil
+var accessLogOutput io.Writer
+
+// accessLogFormat returns the template of the request logger for the given
+// log format
+func accessLogFormat(format string) string {
+	if format == logFormatJSON {
+		return `{"time":"${time_rfc3339}","id":"${id}","remote_ip":"${remote_ip}","latency":"${latency_human}",` +
+			`"method":"${method}","uri":"${uri}","status":${status},"error":"${error}"}` + "\n"
+	}
+
+	return "${time_rfc3339} ${id} ${remote_ip} ${latency_human} ${method} ${uri} ${status} ${error}\n"
+}
+
+// A jsonLogWriter turns the lines written by the standard logger into JSON
+// objects with the time and the message, to be used with log flags set to 0
+type jsonLogWriter struct {
+	w io.Writer
+}
+
+func (j jsonLogWriter) Write(p []byte) (int, error) {
+	entry := struct {
+		Time    string `json:"time"`
+		Message string `json:"message"`
+	}{
+		Time:    time.Now().Format(time.RFC3339),
+		Message: strings.TrimSuffix(string(p), "\n"),
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := j.w.Write(append(data, '\n')); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
@@ -26,19 +26,38 @@
 package main
 
 import (
+	"compress/gzip"
+	"context"
 	"embed"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
+	"github.com/labstack/gommon/bytes"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"golang.org/x/time/rate"
 	"html/template"
 	"io"
 	"io/fs"
 	"log"
+	"math"
+	"mime/multipart"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
 var version string = "0.1.0"
@@ -48,21 +67,263 @@ var version string = "0.1.0"
 type config struct {
 	// Embed template and static files
 	NoEmbed bool
-	// Path to the directory where to list and upload files
+	// Parse templates on each request, only with NoEmbed or TplDir
+	ReloadTemplates bool
+	// Directories of the static files and of the templates, replacing the
+	// embedded ones, or the ones of the current directory with NoEmbed
+	StaticDir string
+	TplDir    string
+	// Path to the directory where to list and upload files. With multiple
+	// stores, handlers get the directory of the store they serve
 	StoreDir string
-	// Listen address
-	ListenAddr string
-	// Listen port
-	Port string
+	// Directories of the stores by name, empty with a single store
+	Stores map[string]string
+	// Name of the store served by a handler, empty with a single store
+	StoreName string
+	// Addresses to listen on, as host:port or unix:/path/to/socket for a
+	// Unix domain socket
+	Listen []string
+	// Maximum size of an upload in bytes, 0 means unlimited
+	MaxUploadSize int64
+	// Maximum number of files in an upload request, 0 means unlimited
+	MaxFiles int
+	// Write the files of multipart uploads to the store as they are read
+	// from the request, instead of buffering the whole form first
+	StreamUploads bool
+	// Name of the field of multipart forms holding the uploaded files,
+	// file parts of other fields are accepted when it is missing
+	UploadField string
+	// What to do when an uploaded file already exists: overwrite, rename or
+	// reject
+	OnConflict string
+	// Default presentation of the listing: table or gallery, of
+	// thumbnails
+	View string
+	// Organization of the uploaded files in the store: flat, in the
+	// requested directory, or date, in subdirectories named after the day
+	// of the upload
+	Layout string
+	// Credentials for HTTP basic auth, disabled when AuthUser is empty. The
+	// password is either given in plaintext or as a bcrypt hash
+	AuthUser     string
+	AuthPassword string
+	AuthHash     string
+	// Executable run in the background on each uploaded file, with the
+	// maximum duration of its execution
+	PostUploadCmd     string
+	PostUploadTimeout time.Duration
+	// File where uploads, deletions, renames and moves are recorded,
+	// disabled when empty
+	AuditLog string
+	// Address of clamd to scan uploaded files for viruses, unix:/path or
+	// host:port, scanning is disabled when empty
+	ClamAV string
+	// Key signing the links to download a file without credentials,
+	// sharing is disabled when empty
+	Secret string
+	// Certificate and key files to serve over HTTPS
+	TLSCert string
+	TLSKey  string
+	// Optional host:port where to redirect HTTP requests to HTTPS
+	RedirectAddr string
+	// Time to wait for active requests to finish on shutdown
+	ShutdownTimeout time.Duration
+	// Maximum durations to read a whole request, including the body of
+	// uploads, to write a response, including downloads, and to wait for
+	// the next request on a kept-alive connection, 0 means unlimited
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+	// Keep connections open to serve the next requests of clients
+	KeepAlive bool
+	// Accept HTTP/2 without TLS, HTTP/2 is always available over TLS
+	H2C bool
+	// Show the SHA-256 digest of files in the listing
+	ShowChecksums bool
+	// Serve QR codes of the download links of files
+	QR bool
+	// Store uploads identical to a file of the store as hard links to it
+	Dedup bool
+	// Keep the digests of uploads so that clients can skip uploading
+	// contents already in the store with If-None-Match, always done with
+	// Dedup
+	ConditionalUploads bool
+	// Answer 404 to the directories of the download route, instead of
+	// serving their index.html page
+	NoFileIndex bool
+	// Leave symbolic links out of the listings and refuse to serve files
+	// through them, they may point outside of the store
+	NoFollowSymlinks bool
+	// Leave the files and directories whose name starts with a dot out of
+	// the listing
+	HideDotfiles bool
+	// Glob patterns of the names left out of the listing
+	Ignore []string
+	// Remove uploaded files after this duration, 0 keeps them forever
+	TTL time.Duration
+	// Serve thumbnails of images, cached in ThumbDir
+	Thumbnails bool
+	ThumbDir   string
+	// Expose Prometheus metrics on /metrics
+	Metrics bool
+	// URL path prefix of all routes, empty or starting with a slash and
+	// without a trailing slash. With multiple stores, handlers get the
+	// prefix of the routes of their store while RootPath keeps the prefix of
+	// the application
+	BasePath string
+	RootPath string
+	// Maximum number of upload requests per second per client IP, 0 means
+	// unlimited
+	RateLimit float64
+	// Get the client IP from the X-Forwarded-For header set by a reverse
+	// proxy, on a private network or in one of the TrustedProxies, given
+	// as IP addresses or CIDR networks
+	TrustProxy     bool
+	TrustedProxies []string
+	// Transliterate uploaded filenames to ASCII
+	ASCIINames bool
+	// Normalize uploaded filenames to Unicode NFC
+	NormalizeNames bool
+	// Length in bytes above which uploaded filenames are truncated, 0 means
+	// unlimited
+	MaxNameLen int
+	// Lowercase extensions, without the leading dot, of the files accepted
+	// or refused on upload. An empty AllowExt accepts any extension
+	AllowExt []string
+	DenyExt  []string
+	// Media types, or families of types like image/*, of the contents
+	// accepted on upload, detected from their first bytes. Any type is
+	// accepted when empty
+	AllowMime []string
+	// Require a token in form submissions against cross-site requests
+	CSRF bool
+	// Origins of the web pages allowed to call the API, * for any origin,
+	// no CORS header is sent when empty
+	CORSOrigins []string
+	// Format of the logs: text or json
+	LogFormat string
+	// Do not log requests, otherwise log them to AccessLogFile, or to the
+	// output of echo when empty
+	NoAccessLog   bool
+	AccessLogFile string
+	// Mode of the store directories when they are created
+	StorePerm os.FileMode
+	// Mode of the stored files, the umask does not apply
+	FilePerm os.FileMode
+	// Directory of the files being uploaded, next to their destination
+	// when empty
+	TmpDir string
+	// Keep the original name, time and client address of uploads in the
+	// sidecar of the files
+	KeepMetadata bool
+	// Accept POST /fetch to store the file of a URL, downloaded in at most
+	// FetchTimeout
+	Fetch        bool
+	FetchTimeout time.Duration
+	// Number of bytes of the files of a multipart form kept in memory,
+	// the rest is written to temporary files
+	MultipartMem int64
+	// Number of entries per page of the listing
+	PerPage int
+	// Where to keep the files: local or s3. With s3, the store directories
+	// only hold the state of the application, like download counts
+	Backend string
+	// Endpoint, bucket and credentials of the S3 service
+	S3Endpoint  string
+	S3Bucket    string
+	S3Region    string
+	S3AccessKey string
+	S3SecretKey string
+	// Connect to the S3 endpoint over plain HTTP
+	S3Insecure bool
+	// Do not compress responses, otherwise compress with GzipLevel
+	NoGzip    bool
+	GzipLevel int
+	// Show a dashboard with the statistics of the stores at the root, a
+	// single store being moved under /browse
+	Dashboard bool
+	// Title of the pages and HTML snippet shown at their bottom
+	Title  string
+	Footer string
+	// Serve the stores over WebDAV on /dav, without modifications when
+	// DAVReadOnly is set
+	DAV         bool
+	DAVReadOnly bool
+	// Maximum total size of the files of each store in bytes, 0 means
+	// unlimited
+	Quota int64
+	// Remove the oldest files of a store when the free space of its disk
+	// is below this number of bytes, 0 disables it. Files modified less
+	// than LowSpaceMinAge ago are kept.
+	LowSpace       int64
+	LowSpaceMinAge time.Duration
+	// Only allow listing and downloading files
+	ReadOnly bool
+	// Only listen on IPv6, otherwise an empty host listens on all IPv4 and
+	// IPv6 addresses
+	IPv6Only bool
+	// Mode of the Unix domain sockets to listen on
+	SocketPerm os.FileMode
 }
 
+// Strategies to handle uploads of files that already exist in the store
+const (
+	conflictOverwrite = "overwrite"
+	conflictRename    = "rename"
+	conflictReject    = "reject"
+)
+
+// Presentations of the listing, with the template rendering them
+const (
+	viewTable   = "table"
+	viewGallery = "gallery"
+)
+
+var viewTemplates = map[string]string{
+	viewTable:   "main.html",
+	viewGallery: "gallery.html",
+}
+
+// Organizations of uploaded files in the store
+const (
+	layoutFlat = "flat"
+	layoutDate = "date"
+)
+
+// Name of the form field holding the CSRF token
+const csrfField = "_csrf"
+
 // newConfig creates the default configuration struct
 func newConfig() config {
 	return config{
-		NoEmbed:    false,
-		StoreDir:   "files",
-		ListenAddr: "0.0.0.0",
-		Port:       "1323",
+		NoEmbed:           false,
+		StoreDir:          "files",
+		Listen:            []string{":1323"},
+		MaxUploadSize:     0,
+		OnConflict:        conflictOverwrite,
+		Layout:            layoutFlat,
+		View:              viewTable,
+		Title:             "Uploader",
+		ShutdownTimeout:   10 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+		KeepAlive:         true,
+		PostUploadTimeout: time.Minute,
+		NormalizeNames:    true,
+		MaxNameLen:        255,
+		UploadField:       "upload",
+		HideDotfiles:      true,
+		LowSpaceMinAge:    time.Hour,
+		CSRF:              true,
+		LogFormat:         logFormatText,
+		StorePerm:         0755,
+		FilePerm:          0644,
+		MultipartMem:      32 << 20,
+		FetchTimeout:      time.Minute,
+		PerPage:           100,
+		SocketPerm:        0660,
+		Backend:           backendLocal,
+		GzipLevel:         gzip.DefaultCompression,
+		ThumbDir:          defaultThumbDir(),
 	}
 }
 
@@ -72,12 +333,107 @@ func parseCli(args []string) config {
 
 	flag.CommandLine = flag.NewFlagSet(args[0], flag.ExitOnError)
 
-	hostPort := flag.String("listen", net.JoinHostPort(c.ListenAddr, c.Port), "listen on this host:port")
+	listens := &listenFlag{values: c.Listen}
+	flag.Var(listens, "listen", "listen on this host:port, or on a Unix socket given as unix:/path/to/socket, repeat to listen on multiple addresses")
 	noEmbed := flag.Bool("no-embed", c.NoEmbed, "serve template and static dir from cwd")
-	storeDir := flag.String("store", c.StoreDir, "destination dir of uploads")
+	reloadTpl := flag.Bool("reload-templates", c.ReloadTemplates, "parse templates on each request, requires -no-embed or -tpl-dir")
+	staticDir := flag.String("static-dir", "", "serve the static files from this directory")
+	tplDir := flag.String("tpl-dir", "", "read the templates from this directory")
+	stores := &storeFlag{values: []string{c.StoreDir}}
+	flag.Var(stores, "store", "destination `dir` of uploads, repeat as name=dir to serve multiple stores")
+	maxSize := flag.String("max-size", "0", "maximum size of uploads, e.g. 50MB or 2GB, 0 means unlimited")
+	maxFiles := flag.Int("max-files", c.MaxFiles, "maximum number of files in an upload request, 0 means unlimited")
+	uploadField := flag.String("upload-field", c.UploadField, "name of the form field holding the uploaded files")
+	streamUploads := flag.Bool("stream-uploads", c.StreamUploads, "write uploaded files to the store while reading the request, without buffering the form")
+	onConflict := flag.String("on-conflict", c.OnConflict, "action when an uploaded file exists: overwrite, rename or reject")
+	view := flag.String("view", c.View, "default presentation of the listing: table, or gallery of thumbnails")
+	layout := flag.String("layout", c.Layout, "organization of uploaded files: flat, or date to store them in YYYY/MM/DD subdirectories")
+	auth := flag.String("auth", "", "require HTTP basic auth with these user:password credentials")
+	authFile := flag.String("auth-file", "", "read basic auth user:bcrypt-hash credentials from this file")
+	postUploadCmd := flag.String("post-upload-cmd", "", "executable run on each uploaded file, given its path as argument")
+	postUploadTimeout := flag.Duration("post-upload-timeout", c.PostUploadTimeout, "maximum duration of the post-upload command")
+	auditLog := flag.String("audit-log", "", "append a JSON line to this file for each upload, deletion, rename and move")
+	clamav := flag.String("clamav", "", "scan uploaded files with the clamd listening on this unix:/path or host:port")
+	secret := flag.String("secret", "", "key signing the links to share files, enables /files/:name/share")
+	tlsCert := flag.String("tls-cert", "", "serve over HTTPS using this certificate file")
+	tlsKey := flag.String("tls-key", "", "serve over HTTPS using this key file")
+	redirectAddr := flag.String("tls-redirect", "", "redirect HTTP requests received on this host:port to HTTPS")
+	shutdownTimeout := flag.Duration("shutdown-timeout", c.ShutdownTimeout, "time to wait for active requests to finish on shutdown")
+	readTimeout := flag.Duration("read-timeout", c.ReadTimeout, "maximum duration to read a request, including uploads, 0 means unlimited")
+	writeTimeout := flag.Duration("write-timeout", c.WriteTimeout, "maximum duration to write a response, including downloads, 0 means unlimited")
+	keepAlive := flag.Bool("keep-alive", c.KeepAlive, "keep connections open for the next requests of clients")
+	cleartextH2 := flag.Bool("h2c", c.H2C, "accept HTTP/2 over plaintext connections")
+	idleTimeout := flag.Duration("idle-timeout", c.IdleTimeout, "maximum duration to wait for the next request on a kept-alive connection, 0 means unlimited")
+	noFileIndex := flag.Bool("no-file-index", c.NoFileIndex, "answer 404 to directories under /files instead of serving their index.html")
+	noFollowSymlinks := flag.Bool("no-follow-symlinks", c.NoFollowSymlinks, "hide symbolic links of the store and refuse to serve files through them")
+	showChecksums := flag.Bool("show-checksums", c.ShowChecksums, "show the SHA-256 digest of files in the listing")
+	hideDotfiles := flag.Bool("hide-dotfiles", c.HideDotfiles, "leave names starting with a dot out of the listing")
+	ignore := flag.String("ignore", "", "comma separated glob patterns of names left out of the listing, e.g. *.tmp,~*")
+	ttl := flag.Duration("ttl", c.TTL, "remove uploaded files after this duration, e.g. 24h, 0 keeps them forever")
+	thumbnails := flag.Bool("thumbnails", c.Thumbnails, "serve thumbnails of images on /thumb/<name>")
+	thumbDir := flag.String("thumb-cache", c.ThumbDir, "directory where to cache thumbnails")
+	metrics := flag.Bool("metrics", c.Metrics, "expose Prometheus metrics on /metrics")
+	basePath := flag.String("base-path", c.BasePath, "URL path prefix of all routes, when behind a reverse proxy")
+	rateLimit := flag.Float64("rate-limit", c.RateLimit, "maximum upload requests per second per client IP, 0 means unlimited")
+	trustProxy := flag.Bool("trust-proxy", c.TrustProxy, "get the client IP from the X-Forwarded-For header")
+	trustedProxies := flag.String("trusted-proxies", "", "comma separated addresses or networks of proxies trusted with -trust-proxy, besides private ones")
+	asciiNames := flag.Bool("ascii-names", c.ASCIINames, "transliterate uploaded filenames to ASCII")
+	normalizeNames := flag.Bool("normalize-names", c.NormalizeNames, "normalize uploaded filenames to Unicode NFC")
+	maxNameLen := flag.Int("max-name-len", c.MaxNameLen, "truncate uploaded filenames longer than this number of bytes, keeping the extension, 0 means unlimited")
+	allowMime := flag.String("allow-mime", "", "only accept uploads whose contents have these comma separated media types, e.g. image/*,application/pdf")
+	allowExt := flag.String("allow-ext", "", "only accept uploads with these comma separated extensions, e.g. jpg,png,tar.gz")
+	denyExt := flag.String("deny-ext", "", "refuse uploads with these comma separated extensions, e.g. exe,sh")
+	csrf := flag.Bool("csrf", c.CSRF, "protect the upload, delete and zip forms against cross-site requests")
+	corsOrigins := flag.String("cors-origins", "", "comma separated origins of web pages allowed to call the API, or *")
+	noAccessLog := flag.Bool("no-access-log", c.NoAccessLog, "do not log requests")
+	accessLogFile := flag.String("log-file", "", "append the log of requests to this file instead of the standard output")
+	logFormat := flag.String("log-format", c.LogFormat, "format of the logs: text or json")
+	storePerm := flag.String("store-perm", fmt.Sprintf("%o", c.StorePerm), "octal mode of the store directories when they are created, subject to the umask")
+	filePerm := flag.String("file-perm", fmt.Sprintf("%o", c.FilePerm), "octal mode of the stored files, the umask does not apply")
+	keepMetadata := flag.Bool("keep-metadata", c.KeepMetadata, "keep the original name, time and client address of uploads, shown in the listing")
+	fetch := flag.Bool("fetch", c.Fetch, "accept POST /fetch to store the file of a URL, which cannot be on the local host or a private network")
+	fetchTimeout := flag.Duration("fetch-timeout", c.FetchTimeout, "maximum duration of the download of a URL given to /fetch")
+	multipartMem := flag.String("multipart-mem", "32MB", "size of the uploaded files kept in memory while parsing a form, the rest goes to temporary files, e.g. 8MB")
+	tmpDir := flag.String("tmp-dir", c.TmpDir, "write the files being uploaded to this directory instead of their destination directory")
+	perPage := flag.Int("per-page", c.PerPage, "default number of files per page of the listing")
+	backend := flag.String("backend", c.Backend, "where to keep uploaded files: local or s3")
+	s3Endpoint := flag.String("s3-endpoint", "", "host:port of the S3 service, with -backend s3")
+	s3Bucket := flag.String("s3-bucket", "", "bucket where to keep files, with -backend s3")
+	s3Region := flag.String("s3-region", "", "region of the bucket, with -backend s3")
+	s3AccessKey := flag.String("s3-access-key", "", "access key of the S3 service, with -backend s3")
+	s3SecretKey := flag.String("s3-secret-key", "", "secret key of the S3 service, with -backend s3")
+	s3Insecure := flag.Bool("s3-insecure", false, "connect to the S3 service over plain HTTP")
+	noGzip := flag.Bool("no-gzip", c.NoGzip, "do not compress responses")
+	gzipLevel := flag.Int("gzip-level", c.GzipLevel, "compression level of responses, from 1 to 9, -1 for the default")
+	title := flag.String("title", c.Title, "title of the pages")
+	footer := flag.String("footer", c.Footer, "HTML snippet shown at the bottom of the pages")
+	dashboard := flag.Bool("dashboard", c.Dashboard, "show the number of files and the disk space of the stores at the root")
+	dav := flag.Bool("dav", c.DAV, "serve the stores over WebDAV on /dav")
+	davReadOnly := flag.Bool("dav-readonly", c.DAVReadOnly, "do not allow modifications over WebDAV")
+	qr := flag.Bool("qr", c.QR, "serve QR codes of the download links of files on /files/<name>/qr")
+	dedup := flag.Bool("dedup", c.Dedup, "store uploads identical to an existing file as hard links to it")
+	conditionalUploads := flag.Bool("conditional-uploads", c.ConditionalUploads, "skip API uploads whose If-None-Match header gives the SHA-256 digest of a file of the store")
+	quota := flag.String("quota", "0", "maximum total size of the files of each store, e.g. 10GB, 0 means unlimited")
+	lowSpace := flag.String("low-space-threshold", "0", "remove the oldest files when the free disk space is below this size, e.g. 5GB, 0 disables it")
+	lowSpaceMinAge := flag.Duration("low-space-min-age", c.LowSpaceMinAge, "never remove files modified less than this duration ago to free space")
+	ipv6Only := flag.Bool("ipv6-only", c.IPv6Only, "only accept IPv6 connections")
+	socketPerm := flag.String("socket-perm", fmt.Sprintf("%o", c.SocketPerm), "octal mode of the Unix socket given to -listen")
+	readOnly := flag.Bool("read-only", c.ReadOnly, "only allow listing and downloading files")
+	configFile := flag.String("config", os.Getenv("UPL_CONFIG"), "read options from this JSON file")
+	dumpConfig := flag.Bool("dump-config", false, "print the resulting configuration as JSON, with secrets redacted, then exit")
 	showVersion := flag.Bool("version", false, "show version")
+	runSelfTest := flag.Bool("selftest", false, "upload, list and download a file on a temporary store, then exit with status 0 on success")
 	showHelp := flag.Bool("help", false, "print help")
 
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", args[0])
+		flag.PrintDefaults()
+		fmt.Fprintln(flag.CommandLine.Output(), "\nOptions can also be set from environment variables named UPL_<OPTION>,")
+		fmt.Fprintln(flag.CommandLine.Output(), "e.g. UPL_STORE or UPL_MAX_SIZE, or from a JSON file given with -config.")
+		fmt.Fprintln(flag.CommandLine.Output(), "The command line takes precedence over the environment, which takes")
+		fmt.Fprintln(flag.CommandLine.Output(), "precedence over the configuration file.")
+	}
+
 	flag.Parse()
 
 	if *showHelp {
@@ -90,47 +446,430 @@ func parseCli(args []string) config {
 		os.Exit(0)
 	}
 
+	if *runSelfTest {
+		if err := selfTest(); err != nil {
+			fmt.Fprintln(os.Stderr, "self-test failed:", err)
+			os.Exit(1)
+		}
+		fmt.Println("self-test passed")
+		os.Exit(0)
+	}
+
+	if err := applyConfigLayers(flag.CommandLine, *configFile); err != nil {
+		log.Fatalln("could not load configuration:", err)
+	}
+
+	// Set up logging first so that all messages have the same format
+	switch *logFormat {
+	case logFormatText:
+	case logFormatJSON:
+		log.SetFlags(0)
+		log.SetOutput(jsonLogWriter{w: os.Stderr})
+	default:
+		log.Fatalln("invalid log format:", *logFormat)
+	}
+	c.LogFormat = *logFormat
+
+	if *noAccessLog && *accessLogFile != "" {
+		log.Fatalln("-no-access-log and -log-file are mutually exclusive")
+	}
+	c.NoAccessLog = *noAccessLog
+	c.AccessLogFile = *accessLogFile
+
 	c.NoEmbed = *noEmbed
-	c.StoreDir = *storeDir
 
-	h, p, err := net.SplitHostPort(*hostPort)
+	for _, dir := range []string{*staticDir, *tplDir} {
+		if dir == "" {
+			continue
+		}
+		if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+			log.Fatalln("no such directory:", dir)
+		}
+	}
+	c.StaticDir = *staticDir
+	c.TplDir = *tplDir
+
+	if *reloadTpl && !c.NoEmbed && c.TplDir == "" {
+		log.Fatalln("-reload-templates requires -no-embed or -tpl-dir")
+	}
+	c.ReloadTemplates = *reloadTpl
+
+	if err := stores.apply(&c); err != nil {
+		log.Fatalln("invalid store:", err)
+	}
+
+	perm, err := strconv.ParseUint(*storePerm, 8, 32)
+	if err != nil || perm > 0777 {
+		log.Fatalln("invalid store perm:", *storePerm)
+	}
+	c.StorePerm = os.FileMode(perm)
+
+	perm, err = strconv.ParseUint(*filePerm, 8, 32)
+	if err != nil || perm > 0777 {
+		log.Fatalln("invalid file perm:", *filePerm)
+	}
+	c.FilePerm = os.FileMode(perm)
+
+	if *tmpDir != "" {
+		if fi, err := os.Stat(*tmpDir); err != nil || !fi.IsDir() {
+			log.Fatalln("invalid tmp dir:", *tmpDir)
+		}
+	}
+	c.TmpDir = *tmpDir
+
+	if *fetchTimeout <= 0 {
+		log.Fatalln("invalid fetch timeout:", *fetchTimeout)
+	}
+	c.Fetch = *fetch
+	c.KeepMetadata = *keepMetadata
+	c.FetchTimeout = *fetchTimeout
+
+	mm, err := bytes.Parse(*multipartMem)
+	if err != nil || mm < 0 {
+		log.Fatalln("invalid multipart memory:", *multipartMem)
+	}
+	c.MultipartMem = mm
+
+	c.ShutdownTimeout = *shutdownTimeout
+
+	if *readTimeout < 0 {
+		log.Fatalln("invalid read timeout:", *readTimeout)
+	}
+	if *writeTimeout < 0 {
+		log.Fatalln("invalid write timeout:", *writeTimeout)
+	}
+	if *idleTimeout < 0 {
+		log.Fatalln("invalid idle timeout:", *idleTimeout)
+	}
+	c.ReadTimeout = *readTimeout
+	c.WriteTimeout = *writeTimeout
+	c.IdleTimeout = *idleTimeout
+	c.ShowChecksums = *showChecksums
+	c.NoFileIndex = *noFileIndex
+	c.NoFollowSymlinks = *noFollowSymlinks
+	c.HideDotfiles = *hideDotfiles
+
+	patterns, err := parseIgnore(*ignore)
+	if err != nil {
+		log.Fatalln("invalid ignore patterns:", err)
+	}
+	c.Ignore = patterns
+
+	if *ttl < 0 {
+		log.Fatalln("invalid ttl:", *ttl)
+	}
+	c.TTL = *ttl
+	c.Metrics = *metrics
+	c.Thumbnails = *thumbnails
+	c.ThumbDir = *thumbDir
+	c.BasePath = normalizeBasePath(*basePath)
+	c.RootPath = c.BasePath
+	c.ASCIINames = *asciiNames
+
+	if *rateLimit < 0 {
+		log.Fatalln("invalid rate limit:", *rateLimit)
+	}
+	c.RateLimit = *rateLimit
+	c.TrustProxy = *trustProxy
+
+	if *trustedProxies != "" {
+		if !c.TrustProxy {
+			log.Fatalln("-trusted-proxies requires -trust-proxy")
+		}
+		nets, err := parseNetworks(*trustedProxies)
+		if err != nil {
+			log.Fatalln("invalid trusted proxies:", err)
+		}
+		for _, n := range nets {
+			c.TrustedProxies = append(c.TrustedProxies, n.String())
+		}
+	}
+	c.NormalizeNames = *normalizeNames
+
+	if *maxNameLen < 0 {
+		log.Fatalln("invalid max name len:", *maxNameLen)
+	}
+	c.MaxNameLen = *maxNameLen
+	c.AllowExt = parseExtList(*allowExt)
+	c.DenyExt = parseExtList(*denyExt)
+
+	mimes, err := parseMimeList(*allowMime)
 	if err != nil {
-		log.Fatalln("invalid host:port")
+		log.Fatalln("invalid allowed media types:", err)
+	}
+	c.AllowMime = mimes
+	c.CSRF = *csrf
+
+	origins, err := parseOrigins(*corsOrigins)
+	if err != nil {
+		log.Fatalln("invalid cors origins:", err)
+	}
+	c.CORSOrigins = origins
+
+	if *perPage < 1 {
+		log.Fatalln("invalid per page:", *perPage)
+	}
+	c.PerPage = *perPage
+
+	size, err := bytes.Parse(*maxSize)
+	if err != nil || size < 0 {
+		log.Fatalln("invalid max size:", *maxSize)
+	}
+	c.MaxUploadSize = size
+
+	if *maxFiles < 0 {
+		log.Fatalln("invalid max files:", *maxFiles)
+	}
+	c.MaxFiles = *maxFiles
+	c.StreamUploads = *streamUploads
+
+	if *uploadField == "" {
+		log.Fatalln("invalid upload field:", *uploadField)
+	}
+	c.UploadField = *uploadField
+
+	q, err := bytes.Parse(*quota)
+	if err != nil || q < 0 {
+		log.Fatalln("invalid quota:", *quota)
+	}
+	c.Quota = q
+
+	ls, err := bytes.Parse(*lowSpace)
+	if err != nil || ls < 0 {
+		log.Fatalln("invalid low space threshold:", *lowSpace)
+	}
+	c.LowSpace = ls
+
+	if *lowSpaceMinAge < 0 {
+		log.Fatalln("invalid low space min age:", *lowSpaceMinAge)
+	}
+	c.LowSpaceMinAge = *lowSpaceMinAge
+
+	switch *onConflict {
+	case conflictOverwrite, conflictRename, conflictReject:
+		c.OnConflict = *onConflict
+	default:
+		log.Fatalln("invalid conflict action:", *onConflict)
+	}
+
+	if _, ok := viewTemplates[*view]; !ok {
+		log.Fatalln("invalid view:", *view)
+	}
+	c.View = *view
+
+	switch *layout {
+	case layoutFlat, layoutDate:
+		c.Layout = *layout
+	default:
+		log.Fatalln("invalid layout:", *layout)
+	}
+
+	if *auth != "" && *authFile != "" {
+		log.Fatalln("-auth and -auth-file are mutually exclusive")
+	}
+
+	if *auth != "" {
+		c.AuthUser, c.AuthPassword, err = parseCredentials(*auth)
+		if err != nil {
+			log.Fatalln("invalid auth:", err)
+		}
+	}
+
+	if *authFile != "" {
+		c.AuthUser, c.AuthHash, err = readCredentialsFile(*authFile)
+		if err != nil {
+			log.Fatalln("invalid auth file:", err)
+		}
+	}
+	c.Secret = *secret
+
+	if *postUploadCmd != "" {
+		cmd, err := exec.LookPath(*postUploadCmd)
+		if err != nil {
+			log.Fatalln("invalid post-upload command:", err)
+		}
+		c.PostUploadCmd = cmd
+	}
+	if *postUploadTimeout <= 0 {
+		log.Fatalln("invalid post-upload timeout:", *postUploadTimeout)
+	}
+	c.PostUploadTimeout = *postUploadTimeout
+	c.AuditLog = *auditLog
+
+	if *clamav != "" {
+		if _, _, err := parseClamdAddr(*clamav); err != nil {
+			log.Fatalln("invalid clamav address:", err)
+		}
+		c.ClamAV = *clamav
+	}
+
+	switch *backend {
+	case backendLocal:
+	case backendS3:
+		if *s3Endpoint == "" || *s3Bucket == "" {
+			log.Fatalln("-backend s3 requires -s3-endpoint and -s3-bucket")
+		}
+		// These features work on the files of the local filesystem
+		if c.TTL > 0 || c.Thumbnails || c.ShowChecksums || *dav || c.PostUploadCmd != "" || c.LowSpace > 0 || *dedup || *conditionalUploads {
+			log.Fatalln("-ttl, -thumbnails, -show-checksums, -dav, -post-upload-cmd, -low-space-threshold, -dedup and -conditional-uploads are not available with -backend s3")
+		}
+	default:
+		log.Fatalln("invalid backend:", *backend)
+	}
+	c.Backend = *backend
+
+	if *gzipLevel < gzip.DefaultCompression || *gzipLevel > gzip.BestCompression {
+		log.Fatalln("invalid gzip level:", *gzipLevel)
+	}
+	c.NoGzip = *noGzip
+	c.Title = *title
+	c.Footer = *footer
+	c.Dashboard = *dashboard
+	c.DAV = *dav
+	c.DAVReadOnly = *davReadOnly || *readOnly
+
+	// WebDAV clients may write to a file in place, changing all the links
+	// to it
+	if *dedup && c.DAV && !c.DAVReadOnly {
+		log.Fatalln("-dedup requires -dav-readonly when -dav is used")
+	}
+
+	// WebDAV clients write files without the checks of uploads
+	if c.DAV && !c.DAVReadOnly && (c.MaxUploadSize > 0 || c.Quota > 0 || len(c.AllowExt) > 0 || len(c.DenyExt) > 0 || len(c.AllowMime) > 0 || c.ClamAV != "") {
+		log.Fatalln("-max-size, -quota, -allow-ext, -deny-ext, -allow-mime and -clamav require -dav-readonly when -dav is used")
+	}
+	c.Dedup = *dedup
+	c.ConditionalUploads = *conditionalUploads
+	c.QR = *qr
+
+	// The WebDAV server follows the links of the store
+	if c.NoFollowSymlinks && c.DAV {
+		log.Fatalln("-no-follow-symlinks cannot be used with -dav")
+	}
+	c.GzipLevel = *gzipLevel
+	c.S3Endpoint = *s3Endpoint
+	c.S3Bucket = *s3Bucket
+	c.S3Region = *s3Region
+	c.S3AccessKey = *s3AccessKey
+	c.S3SecretKey = *s3SecretKey
+	c.S3Insecure = *s3Insecure
+
+	// Expiring files removes them from the store
+	if *readOnly && (c.TTL > 0 || c.LowSpace > 0) {
+		log.Fatalln("-ttl and -low-space-threshold cannot be used with -read-only")
+	}
+	c.ReadOnly = *readOnly
+
+	if err := listens.apply(&c, *ipv6Only); err != nil {
+		log.Fatalln("invalid listen address:", err)
+	}
+	c.IPv6Only = *ipv6Only
+
+	if c.hasSocket() {
+		perm, err := strconv.ParseUint(*socketPerm, 8, 32)
+		if err != nil || perm > 0777 {
+			log.Fatalln("invalid socket perm:", *socketPerm)
+		}
+		c.SocketPerm = os.FileMode(perm)
 	}
 
-	if h == "" {
-		h = "0.0.0.0"
+	if (*tlsCert == "") != (*tlsKey == "") {
+		log.Fatalln("both -tls-cert and -tls-key are required to serve over HTTPS")
+	}
+	if *tlsCert != "" && c.hasSocket() {
+		log.Fatalln("-tls-cert and -tls-key cannot be used with a Unix socket")
+	}
+	c.TLSCert = *tlsCert
+	c.TLSKey = *tlsKey
+	c.KeepAlive = *keepAlive
+
+	if *cleartextH2 && c.TLSCert != "" {
+		log.Fatalln("-h2c cannot be used with -tls-cert, HTTP/2 is already served over TLS")
+	}
+	c.H2C = *cleartextH2
+
+	if *redirectAddr != "" {
+		if c.TLSCert == "" {
+			log.Fatalln("-tls-redirect requires -tls-cert and -tls-key")
+		}
+		if _, _, err := net.SplitHostPort(*redirectAddr); err != nil {
+			log.Fatalln("invalid redirect host:port")
+		}
+		c.RedirectAddr = *redirectAddr
 	}
 
-	c.ListenAddr = h
-	c.Port = p
+	if *dumpConfig {
+		if err := writeConfig(os.Stdout, c); err != nil {
+			log.Fatalln("could not dump configuration:", err)
+		}
+		os.Exit(0)
+	}
 
 	return c
 }
 
+// Time allowed to read the headers of a request, whatever the read timeout, so
+// that slow clients cannot hold connections without sending a request
+const readHeaderTimeout = 30 * time.Second
+
+// setTimeouts applies the timeouts and the keep-alive setting of the
+// configuration to an http server
+func setTimeouts(s *http.Server, c config) {
+	s.ReadHeaderTimeout = readHeaderTimeout
+	s.ReadTimeout = c.ReadTimeout
+	s.WriteTimeout = c.WriteTimeout
+	s.IdleTimeout = c.IdleTimeout
+	s.SetKeepAlivesEnabled(c.KeepAlive)
+}
+
+// normalizeBasePath cleans a URL path prefix so that it is either empty or
+// starts with a slash and has no trailing slash
+func normalizeBasePath(p string) string {
+	p = path.Clean("/" + strings.TrimSpace(p))
+	if p == "/" {
+		return ""
+	}
+	return p
+}
+
 //go:embed static
 var staticFS embed.FS
 
-func selectStaticFS(noEmbed bool) (fs.FS, error) {
-	if noEmbed {
+// selectStaticFS returns the embedded static files. The files of dir when
+// set, or of the static directory of the current directory with noEmbed,
+// replace them one by one, so that only the files to change need to be on
+// disk.
+func selectStaticFS(noEmbed bool, dir string) (fs.FS, error) {
+	subfs, err := fs.Sub(staticFS, "static")
+	if err != nil {
+		return nil, err
+	}
+
+	if dir == "" && noEmbed {
 		cwd, err := os.Getwd()
 		if err != nil {
 			return nil, err
 		}
-		sp := filepath.Join(cwd, "static")
-		return os.DirFS(sp), nil
+		dir = filepath.Join(cwd, "static")
 	}
-	subfs, err := fs.Sub(staticFS, "static")
-	if err != nil {
-		return nil, err
+	if dir != "" {
+		return overlayFS{upper: os.DirFS(dir), lower: subfs}, nil
 	}
+
 	return subfs, nil
 }
 
-//go:embed tpl
+// The pattern includes the partials, whose names start with an underscore
+//
+//go:embed tpl/*.html
 var tplFS embed.FS
 
-func selectTplFS(noEmbed bool) (fs.FS, error) {
+// selectTplFS returns the templates of dir when set, of the tpl directory of
+// the current directory with noEmbed, the embedded ones otherwise
+func selectTplFS(noEmbed bool, dir string) (fs.FS, error) {
+	if dir != "" {
+		return os.DirFS(dir), nil
+	}
 	if noEmbed {
 		cwd, err := os.Getwd()
 		if err != nil {
@@ -149,138 +888,1784 @@ func selectTplFS(noEmbed bool) (fs.FS, error) {
 type Template struct {
 	fs     fs.FS
 	layout string
+	// Templates shared by the pages, their names start with an underscore
+	partials []string
+	// Parse templates on each render instead of using the cached ones
+	reload    bool
+	templates map[string]*template.Template
+}
+
+// newTemplate parses all the page templates of fsys with the layout and the
+// partials
+func newTemplate(fsys fs.FS, layout string, reload bool) (*Template, error) {
+	t := &Template{
+		fs:        fsys,
+		layout:    layout,
+		reload:    reload,
+		templates: make(map[string]*template.Template),
+	}
+
+	partials, err := fs.Glob(fsys, "_*.html")
+	if err != nil {
+		return nil, err
+	}
+	t.partials = partials
+
+	names, err := fs.Glob(fsys, "*.html")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range names {
+		if name == layout || strings.HasPrefix(name, "_") {
+			continue
+		}
+
+		tpl, err := t.parse(name)
+		if err != nil {
+			return nil, err
+		}
+		t.templates[name] = tpl
+	}
+
+	return t, nil
+}
+
+// parse parses the page template name with the layout and the partials
+func (t *Template) parse(name string) (*template.Template, error) {
+	patterns := append([]string{t.layout}, t.partials...)
+	return template.ParseFS(t.fs, append(patterns, name)...)
 }
 
 func (t *Template) Render(w io.Writer, name string, data interface{}, c echo.Context) error {
-	return template.Must(template.ParseFS(t.fs, t.layout, name)).Execute(w, data)
+	if t.reload {
+		tpl, err := t.parse(name)
+		if err != nil {
+			return err
+		}
+		return tpl.Execute(w, data)
+	}
+
+	tpl, ok := t.templates[name]
+	if !ok {
+		return fmt.Errorf("template not found: %s", name)
+	}
+	return tpl.Execute(w, data)
 }
 
-func app(conf config) error {
+// newServer creates the echo instance serving the stores of conf, with all
+// its middleware and routes
+func newServer(conf config) (*echo.Echo, error) {
 	// Echo instance
 	e := echo.New()
 	e.HideBanner = true
 	e.HidePort = true
 
-	// Middleware
-	e.Use(middleware.LoggerWithConfig(middleware.LoggerConfig{
-		Format: "${time_rfc3339} ${remote_ip} ${latency_human} ${method} ${uri} ${status} ${error}\n",
-	}))
-	e.Use(middleware.Recover())
+	if err := openStorages(conf); err != nil {
+		return nil, err
+	}
+
+	if conf.TrustProxy {
+		e.IPExtractor = proxyIPExtractor(conf)
+	}
+
+	// Middleware, the first ones also apply to WebDAV. The request ID
+	// comes first to be logged.
+	base := []echo.MiddlewareFunc{middleware.RequestID()}
+	if !conf.NoAccessLog {
+		base = append(base, middleware.LoggerWithConfig(middleware.LoggerConfig{
+			Format: accessLogFormat(conf.LogFormat),
+			Output: accessLogOutput,
+		}))
+	}
+	base = append(base, middleware.Recover(), allowMethods(e))
+
+	if conf.AuthUser != "" {
+		base = append(base, basicAuth(conf))
+	}
+	e.Use(base...)
+
+	if conf.DAV {
+		e.Pre(davRouter(conf.storeConfigs(), base))
+	}
+
+	if conf.Metrics {
+		// Files are only counted on the local filesystem, listing a
+		// bucket on each scrape would be too expensive
+		if conf.Backend == backendLocal {
+			if err := registerStoreMetrics(conf.storeConfigs()); err != nil {
+				return nil, err
+			}
+		}
+		e.Use(countDownloads)
+	}
+
+	if !conf.NoGzip {
+		e.Use(middleware.GzipWithConfig(middleware.GzipConfig{
+			Skipper: skipGzip,
+			Level:   conf.GzipLevel,
+		}))
+	}
+
+	// The upload form applies the limit in its own middleware, so that
+	// the error is shown on the form
+	if limit := uploadBodyLimit(conf); limit > 0 {
+		e.Use(middleware.BodyLimitWithConfig(middleware.BodyLimitConfig{
+			Skipper: isFormUpload,
+			Limit:   fmt.Sprintf("%dB", limit),
+		}))
+	}
 
 	// Templates from tpl
-	tplfs, err := selectTplFS(conf.NoEmbed)
+	tplfs, err := selectTplFS(conf.NoEmbed, conf.TplDir)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	t := &Template{
-		fs:     tplfs,
-		layout: "layout.html",
+	t, err := newTemplate(tplfs, "layout.html", conf.ReloadTemplates)
+	if err != nil {
+		return nil, err
 	}
 
 	e.Renderer = t
+	e.HTTPErrorHandler = errorHandler(conf)
 
-	stFS, err := selectStaticFS(conf.NoEmbed)
+	stFS, err := selectStaticFS(conf.NoEmbed, conf.StaticDir)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Routes
-	e.GET("/", uplWrapHandler(listFiles, conf))
-	e.POST("/", uplWrapHandler(uploadFiles, conf))
-	e.GET("/static/*", echo.WrapHandler(http.StripPrefix("/static/", http.FileServer(http.FS(stFS)))))
+	g := e.Group(conf.BasePath)
+	if conf.BasePath != "" {
+		getRoute(e, conf.BasePath, redirectSlash)
+	}
+
+	getRoute(g, "/static/*", echo.WrapHandler(staticHandler(stFS, conf.BasePath+"/static/")))
+	getRoute(g, "/favicon.ico", echo.WrapHandler(staticHandler(stFS, conf.BasePath+"/")))
 
-	e.Static("/files", conf.StoreDir)
+	if conf.Metrics {
+		getRoute(g, "/metrics", echo.WrapHandler(promhttp.Handler()))
+		getRoute(g, "/api/stats", uplWrapHandler(apiStats, conf))
+	}
+	getRoute(g, "/version", serveVersion)
 
-	// Start server
-	addr := net.JoinHostPort(conf.ListenAddr, conf.Port)
-	log.Printf("listening on http://%s\n", addr)
-	err = e.Start(addr)
-	e.Logger.Fatal(err)
+	// Only uploads are rate limited, with the same limit for all stores
+	var uploadMiddleware []echo.MiddlewareFunc
+	if conf.RateLimit > 0 {
+		uploadMiddleware = append(uploadMiddleware, rateLimiter(conf.RateLimit))
+	}
+	uploadMiddleware = append(uploadMiddleware, trackProgress)
 
-	return err
+	if len(conf.Stores) == 0 && !conf.Dashboard {
+		registerStoreRoutes(g, conf, uploadMiddleware)
+	} else {
+		if conf.Dashboard {
+			getRoute(g, "/", uplWrapHandler(dashboard, conf))
+		} else {
+			getRoute(g, "/", uplWrapHandler(listStores, conf))
+		}
+		for _, sc := range conf.storeConfigs() {
+			getRoute(e, sc.BasePath, redirectSlash)
+			registerStoreRoutes(e.Group(sc.BasePath), sc, uploadMiddleware)
+		}
+	}
+
+	return e, nil
 }
 
-func main() {
-	conf := parseCli(os.Args)
+func app(conf config) error {
+	startTime = time.Now()
 
-	_, err := os.Stat(conf.StoreDir)
-	if err != nil {
-		if err := os.MkdirAll(conf.StoreDir, 0755); err != nil {
-			log.Fatalln(err)
+	if conf.AccessLogFile != "" {
+		f, err := os.OpenFile(conf.AccessLogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+		if err != nil {
+			return fmt.Errorf("could not open access log: %w", err)
 		}
+		accessLogOutput = f
+		defer f.Close()
 	}
 
-	err = app(conf)
+	e, err := newServer(conf)
 	if err != nil {
-		log.Fatalln(err)
+		return err
 	}
-}
 
-// Handler
-func uplWrapHandler(uf func(echo.Context, config) error, conf config) echo.HandlerFunc {
-	return func(c echo.Context) error { return uf(c, conf) }
-}
+	// The audit log is closed once the server is shut down, after the
+	// last requests
+	if conf.AuditLog != "" {
+		a, err := openAuditLog(conf.AuditLog)
+		if err != nil {
+			return fmt.Errorf("could not open audit log: %w", err)
+		}
+		auditor = a
+		defer func() {
+			if err := a.close(); err != nil {
+				log.Println("could not close audit log:", err)
+			}
+		}()
+	}
 
-func listFiles(c echo.Context, conf config) error {
+	// Background tasks stop when the server shuts down
+	bgCtx, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
 
-	v := struct {
-		Title string
-		Files []string
-	}{
-		Title: "Uploader",
-		Files: listCurrentDir(conf.StoreDir),
+	if conf.TTL > 0 {
+		for _, sc := range conf.storeConfigs() {
+			if err := uploadTimes(sc.StoreDir).load(); err != nil {
+				return fmt.Errorf("could not load upload times: %w", err)
+			}
+			go expireFiles(bgCtx, sc)
+		}
 	}
 
-	return c.Render(http.StatusOK, "main.html", v)
-}
+	if conf.LowSpace > 0 {
+		for _, sc := range conf.storeConfigs() {
+			if _, err := diskFree(sc.StoreDir); err != nil {
+				return fmt.Errorf("-low-space-threshold cannot be used: %w", err)
+			}
+			go freeSpace(bgCtx, sc)
+		}
+	}
 
-func uploadFiles(c echo.Context, conf config) error {
+	// Download counts are not saved in read-only mode, the store
+	// directories may not be writable
+	for _, sc := range conf.storeConfigs() {
+		if err := downloadCounts(sc.StoreDir).load(); err != nil {
+			return fmt.Errorf("could not load download counts: %w", err)
+		}
+		if !conf.ReadOnly {
+			go saveDownloadCounts(bgCtx, sc)
+		}
+	}
 
-	form, err := c.MultipartForm()
+	// Start server, binding all the addresses before serving any of them
+	listeners, err := openListeners(conf)
 	if err != nil {
 		return err
 	}
-	files := form.File["upload"]
-
-	for _, file := range files {
-
-		// Source
-		src, err := file.Open()
-		if err != nil {
-			return err
-		}
-		defer src.Close()
+	errc := make(chan error, len(listeners)+1)
 
-		filename := filepath.Base(filepath.Clean(file.Filename))
-		if filename == "." || filename == "/" {
-			return fmt.Errorf("invalid filename")
+	var redirect *http.Server
+	if conf.TLSCert != "" && conf.RedirectAddr != "" {
+		redirect = &http.Server{
+			Addr:    conf.RedirectAddr,
+			Handler: httpsRedirect(conf.tlsPort()),
 		}
-		filename = filepath.Join(conf.StoreDir, filename)
+		setTimeouts(redirect, conf)
+		go func() {
+			log.Printf("redirecting http://%s to https\n", conf.RedirectAddr)
+			if err := redirect.ListenAndServe(); err != http.ErrServerClosed {
+				errc <- err
+			}
+		}()
+	}
 
-		dst, err := os.Create(filename)
-		if err != nil {
-			return err
-		}
-		defer dst.Close()
+	// All the listeners are served by the same server of echo, so that
+	// shutting it down closes all of them, which removes the Unix sockets
+	srv := e.Server
+	if conf.TLSCert != "" {
+		srv = e.TLSServer
+	}
+	srv.Handler = e
+	if conf.H2C {
+		srv.Handler = h2c.NewHandler(e, &http2.Server{IdleTimeout: conf.IdleTimeout})
+	}
+	srv.ErrorLog = e.StdLogger
+	setTimeouts(srv, conf)
 
-		if _, err := io.Copy(dst, src); err != nil {
-			return nil
-		}
+	for i, l := range listeners {
+		go func(addr string, l net.Listener) {
+			var err error
+			if strings.HasPrefix(addr, socketPrefix) {
+				log.Printf("listening on %s\n", addr)
+				err = srv.Serve(l)
+			} else if conf.TLSCert != "" {
+				log.Printf("listening on https://%s\n", addr)
+				err = srv.ServeTLS(l, conf.TLSCert, conf.TLSKey)
+			} else {
+				log.Printf("listening on http://%s\n", addr)
+				err = srv.Serve(l)
+			}
+			if err != http.ErrServerClosed {
+				errc <- err
+			}
+		}(conf.Listen[i], l)
 	}
 
-	return listFiles(c, conf)
-}
+	// Wait for a signal to shutdown, letting in-flight requests finish, or
+	// for a server to fail
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(quit)
 
-func listCurrentDir(dir string) []string {
-	des, err := os.ReadDir(dir)
-	if err != nil {
-		log.Println("could not read current directory:", err)
-		return []string{}
+	select {
+	case err := <-errc:
+		e.Close()
+		return err
+	case sig := <-quit:
+		log.Printf("received %s, shutting down\n", sig)
 	}
-	f := make([]string, 0, len(des))
+
+	ctx, cancel := context.WithTimeout(context.Background(), conf.ShutdownTimeout)
+	defer cancel()
+
+	if redirect != nil {
+		if err := redirect.Shutdown(ctx); err != nil {
+			log.Println("could not shutdown redirect server:", err)
+		}
+	}
+
+	err = e.Shutdown(ctx)
+	stopBackground()
+
+	if conf.TTL > 0 {
+		for _, sc := range conf.storeConfigs() {
+			if err := uploadTimes(sc.StoreDir).save(); err != nil {
+				log.Println("could not save upload times:", err)
+			}
+		}
+	}
+
+	if !conf.ReadOnly {
+		for _, sc := range conf.storeConfigs() {
+			if err := downloadCounts(sc.StoreDir).save(); err != nil {
+				log.Println("could not save download counts:", err)
+			}
+		}
+	}
+
+	return err
+}
+
+// registerStoreRoutes adds the routes to list, upload and download the files
+// of the store of conf to the group. The upload routes get the extra
+// middleware.
+func registerStoreRoutes(g *echo.Group, conf config, uploadMiddleware []echo.MiddlewareFunc) {
+	// Routes of the HTML forms are protected against cross-site requests,
+	// the API is not because it is not used by browsers
+	var formMiddleware []echo.MiddlewareFunc
+	if conf.CSRF {
+		formMiddleware = append(formMiddleware, csrfProtection(conf.RootPath))
+	}
+
+	// The body of uploads is limited and tracked before the CSRF token is
+	// read from the form, which buffers it with the configured memory
+	formUploadMiddleware := []echo.MiddlewareFunc{formErrors(conf)}
+	if limit := uploadBodyLimit(conf); limit > 0 {
+		formUploadMiddleware = append(formUploadMiddleware, middleware.BodyLimit(fmt.Sprintf("%dB", limit)))
+	}
+	formUploadMiddleware = append(formUploadMiddleware, uploadMiddleware...)
+	if conf.CSRF {
+		formUploadMiddleware = append(formUploadMiddleware, bufferForm(conf))
+	}
+	formUploadMiddleware = append(formUploadMiddleware, formMiddleware...)
+
+	// The API can be called by scripts of web pages served from the
+	// origins allowed by the configuration
+	var apiMiddleware []echo.MiddlewareFunc
+	cors := apiCORS(conf)
+	if cors != nil {
+		apiMiddleware = append(apiMiddleware, cors)
+	}
+	apiUploadMiddleware := append(append([]echo.MiddlewareFunc{}, apiMiddleware...), uploadMiddleware...)
+
+	getRoute(g, "/", uplWrapHandler(listFiles, conf), formMiddleware...)
+	g.POST("/download-zip", uplWrapHandler(downloadZip, conf), formMiddleware...)
+	getRoute(g, "/download-tar", uplWrapHandler(downloadTar, conf))
+	getRoute(g, "/api/files", uplWrapHandler(apiListFiles, conf), apiMiddleware...)
+	if cors != nil {
+		g.OPTIONS("/api/files", echo.MethodNotAllowedHandler, cors)
+	}
+
+	// Checksums and resumable uploads work on the files of the local
+	// filesystem
+	if conf.Backend == backendLocal {
+		getRoute(g, "/files/:name/sha256", uplWrapHandler(fileChecksum, conf))
+		g.POST("/files/:name/sha256", uplWrapHandler(fileChecksum, conf))
+	}
+	if conf.Secret != "" {
+		getRoute(g, "/files/:name/share", uplWrapHandler(shareFile, conf))
+	}
+	if conf.QR {
+		getRoute(g, "/files/:name/qr", uplWrapHandler(fileQR, conf))
+	}
+
+	// Routes modifying the store are not available in read-only mode
+	if !conf.ReadOnly {
+		g.POST("/", uplWrapHandler(uploadFiles, conf), formUploadMiddleware...)
+		g.POST("/paste", uplWrapHandler(pasteText, conf), formUploadMiddleware...)
+		if conf.Fetch {
+			g.POST("/fetch", uplWrapHandler(fetchURL, conf), formUploadMiddleware...)
+		}
+		g.POST("/delete", uplWrapHandler(deleteFile, conf), formMiddleware...)
+		g.POST("/rename", uplWrapHandler(renameFile, conf), formMiddleware...)
+		g.POST("/move", uplWrapHandler(moveFile, conf), formMiddleware...)
+		if conf.Backend == backendLocal {
+			g.POST("/mkdir", uplWrapHandler(makeDir, conf), formMiddleware...)
+		}
+		g.POST("/api/files", uplWrapHandler(apiUploadFiles, conf), apiUploadMiddleware...)
+		g.POST("/api/upload", uplWrapHandler(apiUpload, conf), apiUploadMiddleware...)
+		// Progress events are streamed until the upload ends, a HEAD
+		// request would wait for nothing
+		g.GET("/progress/:id", uplWrapHandler(uploadProgressEvents, conf))
+		if cors != nil {
+			g.OPTIONS("/api/upload", echo.MethodNotAllowedHandler, cors)
+		}
+
+		if conf.Backend == backendLocal {
+			g.PUT("/files/:name", uplWrapHandler(resumableUpload, conf), uploadMiddleware...)
+			g.HEAD("/files/:name", uplWrapHandler(resumableStatus, conf))
+		}
+	}
+
+	// HEAD requests on files at the root of the store report the progress
+	// of resumable uploads in progress when they are enabled, the other
+	// ones get the headers of the download
+	getRoute(g, "/files/*", uplWrapHandler(serveFile, conf))
+	if !conf.ReadOnly && conf.Backend == backendLocal {
+		g.GET("/files/:name", uplWrapHandler(serveFile, conf))
+	} else {
+		getRoute(g, "/files/:name", uplWrapHandler(serveFile, conf))
+	}
+
+	// The password of protected files is posted by the form shown when
+	// downloading them
+	g.POST("/files/*", uplWrapHandler(serveFile, conf))
+	g.POST("/files/:name", uplWrapHandler(serveFile, conf))
+
+	if conf.Thumbnails {
+		getRoute(g, "/thumb/:name", uplWrapHandler(thumbnail, conf))
+	}
+	getRoute(g, "/preview/:name", uplWrapHandler(preview, conf))
+}
+
+// Room for the headers of a part of a multipart form, or for its fields
+const partOverhead = maxFieldSize
+
+// uploadBodyLimit returns the maximum size of the body of requests, so that
+// oversized uploads are rejected before being read. MaxUploadSize applies to
+// each file, checked on the size of its part, so the body has room for
+// MaxFiles files of this size with the framing of their part, a single one
+// when the number of files is not limited. It is 0, unlimited, without
+// maximum upload size.
+func uploadBodyLimit(conf config) int64 {
+	if conf.MaxUploadSize == 0 {
+		return 0
+	}
+
+	files := int64(conf.MaxFiles)
+	if files == 0 {
+		files = 1
+	}
+	return files*(conf.MaxUploadSize+partOverhead) + partOverhead
+}
+
+// redirectSlash redirects to the same path with a trailing slash, for the
+// base path of groups
+func redirectSlash(c echo.Context) error {
+	return c.Redirect(http.StatusMovedPermanently, c.Request().URL.Path+"/")
+}
+
+// rateLimiter returns a middleware allowing r requests per second per client
+// IP. Denied requests get a 429 with a Retry-After header.
+func rateLimiter(r float64) echo.MiddlewareFunc {
+	store := middleware.NewRateLimiterMemoryStoreWithConfig(middleware.RateLimiterMemoryStoreConfig{
+		Rate:  rate.Limit(r),
+		Burst: int(math.Max(1, math.Ceil(r))),
+	})
+
+	retryAfter := strconv.Itoa(int(math.Max(1, math.Ceil(1/r))))
+
+	return middleware.RateLimiterWithConfig(middleware.RateLimiterConfig{
+		Store: store,
+		IdentifierExtractor: func(c echo.Context) (string, error) {
+			return c.RealIP(), nil
+		},
+		DenyHandler: func(c echo.Context, identifier string, err error) error {
+			c.Response().Header().Set("Retry-After", retryAfter)
+			return echo.NewHTTPError(http.StatusTooManyRequests, "rate limit exceeded")
+		},
+	})
+}
+
+// skipGzip tells if the response of a request should not be compressed:
+// downloads, thumbnails and archives are served as is because most of them
+// are already compressed, progress events must not wait in a buffer
+func skipGzip(c echo.Context) bool {
+	route := c.Path()
+	for _, suffix := range []string{"/files/*", "/files/:name", "/thumb/:name", "/download-zip", "/download-tar", "/progress/:id"} {
+		if strings.HasSuffix(route, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// csrfProtection returns a middleware checking that form submissions carry
+// the token given in the csrf cookie. The token is available to templates
+// from the csrf key of the context.
+func csrfProtection(rootPath string) echo.MiddlewareFunc {
+	return middleware.CSRFWithConfig(middleware.CSRFConfig{
+		TokenLookup:    "form:" + csrfField,
+		CookiePath:     rootPath + "/",
+		CookieHTTPOnly: true,
+		CookieSameSite: http.SameSiteStrictMode,
+	})
+}
+
+// httpsRedirect returns a handler redirecting requests to the same URL over
+// HTTPS on the given port
+func httpsRedirect(port string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+
+		target := url.URL{
+			Scheme:   "https",
+			Host:     host,
+			Path:     r.URL.Path,
+			RawQuery: r.URL.RawQuery,
+		}
+		http.Redirect(w, r, target.String(), http.StatusMovedPermanently)
+	})
+}
+
+// checkStoreDir tells if the directory of a store exists. Paths that exist
+// but cannot be used as a directory are errors with a message telling why.
+func checkStoreDir(dir string) (bool, error) {
+	fi, err := os.Stat(dir)
+	if err == nil {
+		if !fi.IsDir() {
+			return false, fmt.Errorf("store directory %s is not a directory", dir)
+		}
+		return true, nil
+	}
+
+	// Stat follows symbolic links, a link that cannot be resolved, to a
+	// missing target or in a loop, cannot be created as a directory
+	if li, lerr := os.Lstat(dir); lerr == nil && li.Mode()&fs.ModeSymlink != 0 {
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, fmt.Errorf("store directory %s is a symbolic link to a missing target", dir)
+		}
+		return false, fmt.Errorf("store directory %s is a symbolic link that cannot be followed: %w", dir, err)
+	}
+
+	// The closest existing parent must be a directory for the store to be
+	// created
+	for p := filepath.Dir(dir); ; p = filepath.Dir(p) {
+		if pi, perr := os.Stat(p); perr == nil {
+			if !pi.IsDir() {
+				return false, fmt.Errorf("store directory %s cannot be created, %s is not a directory", dir, p)
+			}
+			break
+		}
+		if p == filepath.Dir(p) {
+			break
+		}
+	}
+
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	return false, fmt.Errorf("store directory %s: %w", dir, err)
+}
+
+// prepareStoreDir creates the directory of a store when it does not exist
+// and checks that files can be created inside
+func prepareStoreDir(dir string, perm os.FileMode) error {
+	exists, err := checkStoreDir(dir)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		if err := os.MkdirAll(dir, perm); err != nil {
+			return fmt.Errorf("could not create store directory: %w", err)
+		}
+	}
+
+	f, err := os.CreateTemp(dir, ".upl-check-*")
+	if err != nil {
+		fi, serr := os.Stat(dir)
+		if serr != nil {
+			return fmt.Errorf("store directory %s is not writable: %w", dir, err)
+		}
+		return fmt.Errorf("store directory %s is not writable (mode %o, -store-perm is applied subject to the umask): %w",
+			dir, fi.Mode().Perm(), err)
+	}
+	f.Close()
+
+	return os.Remove(f.Name())
+}
+
+func main() {
+	conf := parseCli(os.Args)
+
+	// In read-only mode, the stores are not created, they are expected to
+	// exist
+	for _, sc := range conf.storeConfigs() {
+		if conf.ReadOnly {
+			exists, err := checkStoreDir(sc.StoreDir)
+			if err != nil {
+				log.Fatalln(err)
+			}
+			if !exists {
+				log.Fatalln("store directory does not exist:", sc.StoreDir)
+			}
+			continue
+		}
+		if err := prepareStoreDir(sc.StoreDir, conf.StorePerm); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	err := app(conf)
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// Handler
+func uplWrapHandler(uf func(echo.Context, config) error, conf config) echo.HandlerFunc {
+	return func(c echo.Context) error { return uf(c, conf) }
+}
+
+func listFiles(c echo.Context, conf config) error {
+
+	if wantsJSON(c) {
+		return apiListFiles(c, conf)
+	}
+
+	return renderListing(c, conf, http.StatusOK, "")
+}
+
+// renderListing renders the listing page with the status code, showing the
+// message as an error above the forms when not empty
+func renderListing(c echo.Context, conf config, code int, message string) error {
+	st := storeStorage(conf)
+	rel, err := storageDir(st, c.FormValue("path"))
+	unavailable := errors.Is(err, errUnavailable)
+	if err != nil && !unavailable {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+
+	lq, err := parseListQuery(c, conf.PerPage)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	view := conf.View
+	if q := c.FormValue("view"); q != "" {
+		view = q
+	}
+	name, ok := viewTemplates[view]
+	if !ok {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid view: %q", view))
+	}
+
+	// An unavailable store is shown with a banner instead of looking empty
+	var (
+		files []fileEntry
+		total int
+	)
+	if !unavailable {
+		files, total, err = loadListing(st, rel, lq, conf)
+		unavailable = errors.Is(err, errUnavailable)
+		if err != nil && !unavailable {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+	}
+	if unavailable {
+		log.Println(err)
+		code = http.StatusServiceUnavailable
+	}
+
+	v := listView{
+		Root:           conf.RootPath,
+		BasePath:       conf.BasePath,
+		Store:          conf.StoreName,
+		Title:          conf.Title,
+		Footer:         template.HTML(conf.Footer),
+		Path:           rel,
+		Parent:         parentPath(rel),
+		Files:          files,
+		Sort:           lq.Sort,
+		Order:          lq.Order,
+		Query:          lq.Filter,
+		Page:           lq.Page,
+		PerPage:        lq.PerPage,
+		DefaultPerPage: conf.PerPage,
+		Total:          total,
+		View:           view,
+		DefaultView:    conf.View,
+		Thumbnails:     conf.Thumbnails,
+		ShowChecksums:  conf.ShowChecksums,
+		QR:             conf.QR,
+		ShowExpiry:     conf.TTL > 0,
+		ReadOnly:       conf.ReadOnly,
+		CanMkdir:       conf.Backend == backendLocal,
+		Fetch:          conf.Fetch,
+		UploadField:    conf.UploadField,
+		MaxFiles:       conf.MaxFiles,
+		Description:    loadDescription(st, rel),
+		Error:          message,
+		Unavailable:    unavailable,
+	}
+
+	if conf.MaxUploadSize > 0 {
+		v.MaxUploadSize = bytes.Format(conf.MaxUploadSize)
+	}
+
+	if token, ok := c.Get("csrf").(string); ok {
+		v.CSRFField = csrfField
+		v.CSRFToken = token
+	}
+
+	if conf.Quota > 0 {
+		used, err := storeUsage(conf).get(st)
+		if err != nil {
+			log.Println("could not compute disk usage:", err)
+		} else {
+			v.Usage = fmt.Sprintf("%s used of %s", bytes.Format(used), bytes.Format(conf.Quota))
+		}
+	}
+
+	return c.Render(code, name, v)
+}
+
+// A listView holds the data used to render the listing template
+type listView struct {
+	// URL path prefixes of the application and of the store for links
+	Root     string
+	BasePath string
+	// Name of the store, empty with a single store
+	Store string
+	Title string
+	// Footer of the configuration, trusted HTML
+	Footer template.HTML
+	Path   string
+	Parent string
+	Files  []fileEntry
+	// Current sort key and order
+	Sort  string
+	Order string
+	// Filter of the names of the files
+	Query string
+	// Current page, number of entries per page and total number of entries
+	// of the listing
+	Page           int
+	PerPage        int
+	DefaultPerPage int
+	Total          int
+	// Presentation of the listing, and the one of the configuration, kept
+	// out of the links when the same
+	View        string
+	DefaultView string
+	// Thumbnails of images can be shown in the gallery
+	Thumbnails bool
+	// Display the SHA-256 column
+	ShowChecksums bool
+	// Display the time left before files expire
+	ShowExpiry bool
+	// Name and value of the hidden field holding the CSRF token, empty
+	// when the protection is disabled
+	CSRFField string
+	CSRFToken string
+	// Disk usage of the store compared to the quota, empty without quota
+	Usage string
+	// Link to the QR code of each file
+	QR bool
+	// Hide the forms modifying the store
+	ReadOnly bool
+	// Directories can be created, they only exist on the local filesystem
+	CanMkdir bool
+	// Show the form to store the file of a URL
+	Fetch bool
+	// Name of the field of the upload form
+	UploadField string
+	// Limits of uploads, empty or zero when unlimited
+	MaxUploadSize string
+	MaxFiles      int
+	// Error of the previous request, shown above the forms
+	Error string
+	// The contents of the store cannot be read, it is not empty
+	Unavailable bool
+	// Rendered description file of the directory, empty without one
+	Description template.HTML
+}
+
+// Folders returns the directories files can be moved to from the listing:
+// the root of the store, the parent directory and the subdirectories
+func (v listView) Folders() []string {
+	folders := make([]string, 0)
+	if v.Path != "" {
+		folders = append(folders, "/")
+		if v.Parent != "" {
+			folders = append(folders, "/"+v.Parent)
+		}
+	}
+	for _, f := range v.Files {
+		if f.IsDir {
+			folders = append(folders, "/"+f.Path)
+		}
+	}
+	return folders
+}
+
+// SortURL returns the URL of the listing sorted by the given key. The order is
+// reversed when the listing is already sorted by this key.
+func (v listView) SortURL(by string) string {
+	order := sortAsc
+	if v.Sort == by && v.Order == sortAsc {
+		order = sortDesc
+	}
+
+	return v.listURL(by, order, 1)
+}
+
+// PrevURL returns the URL of the previous page of the listing, empty on the
+// first page
+func (v listView) PrevURL() string {
+	if v.Page <= 1 {
+		return ""
+	}
+	return v.listURL(v.Sort, v.Order, v.Page-1)
+}
+
+// NextURL returns the URL of the next page of the listing, empty on the last
+// page
+func (v listView) NextURL() string {
+	if v.Page >= v.Pages() {
+		return ""
+	}
+	return v.listURL(v.Sort, v.Order, v.Page+1)
+}
+
+// Pages returns the number of pages of the listing
+func (v listView) Pages() int {
+	if v.PerPage <= 0 || v.Total == 0 {
+		return 1
+	}
+	return (v.Total + v.PerPage - 1) / v.PerPage
+}
+
+// listURL builds the URL of the listing with the current path and filter
+func (v listView) listURL(by string, order string, page int) string {
+	q := url.Values{}
+	if v.Path != "" {
+		q.Set("path", v.Path)
+	}
+	if v.Query != "" {
+		q.Set("q", v.Query)
+	}
+	q.Set("sort", by)
+	q.Set("order", order)
+	if page > 1 {
+		q.Set("page", strconv.Itoa(page))
+	}
+	if v.PerPage != v.DefaultPerPage {
+		q.Set("per-page", strconv.Itoa(v.PerPage))
+	}
+	if v.View != v.DefaultView {
+		q.Set("view", v.View)
+	}
+
+	return v.BasePath + "/?" + q.Encode()
+}
+
+// DirURL returns the URL of the listing of the directory p, in the current
+// view
+func (v listView) DirURL(p string) string {
+	q := url.Values{}
+	q.Set("path", p)
+	if v.View != v.DefaultView {
+		q.Set("view", v.View)
+	}
+
+	return v.BasePath + "/?" + q.Encode()
+}
+
+// ViewURL returns the URL of the current listing in the given view
+func (v listView) ViewURL(view string) string {
+	v.View = view
+	return v.listURL(v.Sort, v.Order, v.Page)
+}
+
+// SortIcon returns the icon class showing the sort order next to the header
+// of the current sort key
+func (v listView) SortIcon(by string) string {
+	if v.Sort != by {
+		return ""
+	}
+	if v.Order == sortDesc {
+		return "fa-sort-desc"
+	}
+	return "fa-sort-asc"
+}
+
+func apiListFiles(c echo.Context, conf config) error {
+
+	st := storeStorage(conf)
+	rel, err := storageDir(st, c.FormValue("path"))
+	if errors.Is(err, errUnavailable) {
+		return unavailableError(err)
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+
+	// The whole listing is sent unless a page is requested, the total
+	// number of entries is then given in a header
+	perPage := 0
+	if c.FormValue("page") != "" || c.FormValue("per-page") != "" {
+		perPage = conf.PerPage
+	}
+
+	lq, err := parseListQuery(c, perPage)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	files, total, err := loadListing(st, rel, lq, conf)
+	if errors.Is(err, errUnavailable) {
+		return unavailableError(err)
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	if lq.PerPage > 0 {
+		c.Response().Header().Set(headerTotalCount, strconv.Itoa(total))
+	}
+
+	return c.JSON(http.StatusOK, files)
+}
+
+// Header giving the total number of entries of a paginated listing
+const headerTotalCount = "X-Total-Count"
+
+// A listQuery holds the parameters of a listing request
+type listQuery struct {
+	// Sort key and order
+	Sort  string
+	Order string
+	// Filter of the names
+	Filter string
+	// Page to show, starting at 1, and number of entries per page, 0
+	// shows all entries
+	Page    int
+	PerPage int
+}
+
+// parseListQuery reads the parameters of a listing request, perPage is the
+// number of entries per page when not given by the client
+func parseListQuery(c echo.Context, perPage int) (listQuery, error) {
+	lq := listQuery{
+		Filter:  c.FormValue("q"),
+		Page:    1,
+		PerPage: perPage,
+	}
+	lq.Sort, lq.Order = parseSort(c.FormValue("sort"), c.FormValue("order"))
+
+	if p := c.FormValue("page"); p != "" {
+		page, err := strconv.Atoi(p)
+		if err != nil || page < 1 {
+			return lq, fmt.Errorf("invalid page: %q", p)
+		}
+		lq.Page = page
+	}
+
+	if p := c.FormValue("per-page"); p != "" {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 1 {
+			return lq, fmt.Errorf("invalid per-page: %q", p)
+		}
+		lq.PerPage = n
+	}
+
+	return lq, nil
+}
+
+// loadListing reads the contents of the directory rel of the storage, keeps
+// the entries matching the filter, sorts them and adds the optional metadata
+// enabled in the configuration to the entries of the requested page. The
+// total number of matching entries is returned along with the page.
+func loadListing(st storage, rel string, lq listQuery, conf config) ([]fileEntry, int, error) {
+	files, err := st.List(rel)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w: could not read %q: %v", errUnavailable, rel, err)
+	}
+	files, withMeta := splitMetaFiles(files)
+	files = hideEntries(files, conf)
+
+	files, err = filterEntries(files, lq.Filter)
+	if err != nil {
+		return nil, 0, err
+	}
+	sortEntries(files, lq.Sort, lq.Order)
+
+	total := len(files)
+	files = paginate(files, lq.Page, lq.PerPage)
+
+	// Checksums are only available with the local backend
+	if conf.ShowChecksums {
+		addChecksums(files, conf)
+	}
+
+	if conf.TTL > 0 {
+		addExpiry(files, conf)
+	}
+
+	addDownloadCounts(files, conf.StoreDir)
+	addMetadata(files, st, rel, withMeta, conf.KeepMetadata)
+
+	return files, total, nil
+}
+
+// paginate returns the entries of the given page, starting at 1. A page past
+// the end is empty.
+func paginate(files []fileEntry, page int, perPage int) []fileEntry {
+	if perPage <= 0 {
+		return files
+	}
+
+	start := (page - 1) * perPage
+	if start >= len(files) {
+		return files[:0]
+	}
+
+	end := start + perPage
+	if end > len(files) {
+		end = len(files)
+	}
+
+	return files[start:end]
+}
+
+// filterEntries keeps the entries whose name contains q, ignoring case. When
+// q contains a star, it is a glob pattern that must match the whole name.
+func filterEntries(files []fileEntry, q string) ([]fileEntry, error) {
+	q = strings.ToLower(strings.TrimSpace(q))
+	if q == "" {
+		return files, nil
+	}
+
+	glob := strings.Contains(q, "*")
+	if glob {
+		if _, err := path.Match(q, ""); err != nil {
+			return nil, fmt.Errorf("invalid search pattern: %q", q)
+		}
+	}
+
+	kept := files[:0]
+	for _, f := range files {
+		name := strings.ToLower(f.Name)
+		if glob {
+			if ok, _ := path.Match(q, name); !ok {
+				continue
+			}
+		} else if !strings.Contains(name, q) {
+			continue
+		}
+		kept = append(kept, f)
+	}
+
+	return kept, nil
+}
+
+// Keys and orders to sort the listing
+const (
+	sortByName = "name"
+	sortBySize = "size"
+	sortByDate = "date"
+	sortAsc    = "asc"
+	sortDesc   = "desc"
+)
+
+// parseSort validates the sort key and order given by the client, falling
+// back to the default of sorting by name in ascending order
+func parseSort(by string, order string) (string, string) {
+	switch by {
+	case sortByName, sortBySize, sortByDate:
+	default:
+		by = sortByName
+	}
+
+	if order != sortDesc {
+		order = sortAsc
+	}
+
+	return by, order
+}
+
+// sortEntries sorts the entries of a listing in place, entries with equal keys
+// are ordered by name
+func sortEntries(files []fileEntry, by string, order string) {
+	less := func(a, b fileEntry) bool {
+		switch by {
+		case sortBySize:
+			if a.Size != b.Size {
+				return a.Size < b.Size
+			}
+		case sortByDate:
+			if !a.ModTime.Equal(b.ModTime) {
+				return a.ModTime.Before(b.ModTime)
+			}
+		}
+		return a.Name < b.Name
+	}
+
+	sort.SliceStable(files, func(i, j int) bool {
+		if order == sortDesc {
+			return less(files[j], files[i])
+		}
+		return less(files[i], files[j])
+	})
+}
+
+// wantsJSON tells if the client asked for JSON rather than HTML in the Accept
+// header of the request
+func wantsJSON(c echo.Context) bool {
+	accept := c.Request().Header.Get(echo.HeaderAccept)
+	return strings.Contains(accept, echo.MIMEApplicationJSON) && !strings.Contains(accept, echo.MIMETextHTML)
+}
+
+func uploadFiles(c echo.Context, conf config) error {
+
+	if _, err := storeUploads(c, conf); err != nil {
+		return err
+	}
+
+	return listFiles(c, conf)
+}
+
+func apiUploadFiles(c echo.Context, conf config) error {
+
+	sf, exists, err := existingUpload(c, conf)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return c.JSON(http.StatusOK, []storedFile{sf})
+	}
+
+	stored, err := storeUploads(c, conf)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, stored)
+}
+
+// apiUpload stores the files of a multipart form like apiUploadFiles, the
+// response is an object with the list of files in its files member
+func apiUpload(c echo.Context, conf config) error {
+
+	sf, exists, err := existingUpload(c, conf)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return c.JSON(http.StatusOK, map[string][]storedFile{"files": {sf}})
+	}
+
+	stored, err := storeUploads(c, conf)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusCreated, map[string][]storedFile{"files": stored})
+}
+
+// A storedFile describes a file successfully uploaded
+type storedFile struct {
+	// Final name of the file in the store, after conflict handling
+	Name string `json:"name"`
+	// Slash separated path relative to the store directory
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	// Download URL of the file
+	URL string `json:"url"`
+	// The contents were already in the store, as told by If-None-Match,
+	// and were not uploaded again
+	Exists bool `json:"exists,omitempty"`
+}
+
+// storeUploads writes the files of the upload field of a multipart form to
+// the store directory, or the subdirectory given by the path field
+func storeUploads(c echo.Context, conf config) ([]storedFile, error) {
+
+	// The form is already buffered when a middleware has read a field
+	if conf.StreamUploads && c.Request().MultipartForm == nil {
+		return streamUploads(c, conf)
+	}
+
+	start := time.Now()
+	defer func() { uploadDuration.Observe(time.Since(start).Seconds()) }()
+
+	form, err := parseMultipartForm(c, conf)
+	if err != nil {
+		return nil, multipartError(err)
+	}
+	files := uploadedFiles(form, conf.UploadField)
+	if len(files) == 0 {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "no file in the form")
+	}
+	if conf.MaxFiles > 0 && len(files) > conf.MaxFiles {
+		return nil, echo.NewHTTPError(http.StatusBadRequest,
+			fmt.Sprintf("too many files: maximum is %d per upload", conf.MaxFiles))
+	}
+
+	st := storeStorage(conf)
+	rel, err := storageDir(st, c.FormValue("path"))
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+
+	// Check sizes and names before writing anything so that the whole
+	// request is rejected when one of the files is not acceptable
+	names := make([]string, len(files))
+	sums := make([]string, len(files))
+	var incoming int64
+	for i, file := range files {
+		file.Filename = decodeFilename(file.Filename, file.Header)
+		if conf.MaxUploadSize > 0 && file.Size > conf.MaxUploadSize {
+			return nil, echo.NewHTTPError(http.StatusRequestEntityTooLarge,
+				fmt.Sprintf("%s is too large: maximum upload size is %s", file.Filename, bytes.Format(conf.MaxUploadSize)))
+		}
+		incoming += file.Size
+
+		name, err := sanitizeFilename(file.Filename, conf)
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+
+		if err := checkExtension(name, conf); err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		names[i] = name
+
+		sums[i], err = expectedChecksum(c.Request().Header, file.Header, len(files) == 1)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	release, err := reserveQuota(conf, incoming)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	// Check the type of the contents of all the files, and their digest
+	// when the client gives it, before storing any of them
+	for i, file := range files {
+		src, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+		err = sniffUpload(conf, names[i], src)
+		if err == nil && sums[i] != "" {
+			if _, err = src.Seek(0, io.SeekStart); err == nil {
+				err = verifyChecksum(src, sums[i], file.Filename)
+			}
+		}
+		src.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Scan all the files before storing any of them
+	if conf.ClamAV != "" {
+		for i, file := range files {
+			src, err := file.Open()
+			if err != nil {
+				return nil, err
+			}
+			err = scanUpload(conf, names[i], src)
+			src.Close()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// All the files of the upload share the same optional password
+	meta, err := passwordMeta(c.FormValue(passwordField))
+	if err != nil {
+		return nil, err
+	}
+
+	rel, err = uploadDir(conf, st, rel, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	stored := make([]storedFile, 0, len(files))
+	rejected := make([]string, 0)
+	for i, file := range files {
+		// Source
+		src, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer src.Close()
+
+		sf, ok, err := storeFile(conf, st, rel, names[i], src, file.Size)
+		if err != nil {
+			return nil, storeError(file.Filename, err)
+		}
+		if !ok {
+			rejected = append(rejected, names[i])
+			continue
+		}
+		if err := saveUploadMeta(c, conf, st, sf.Path, meta, file.Filename); err != nil {
+			return nil, fmt.Errorf("could not save the metadata of %s: %w", sf.Name, err)
+		}
+		stored = append(stored, sf)
+		audit(c, conf, auditUpload, sf.Path, "", sf.Size)
+		runPostUpload(conf, sf.Path, file.Filename)
+	}
+
+	if len(rejected) > 0 {
+		return nil, echo.NewHTTPError(http.StatusConflict,
+			fmt.Sprintf("files already exist: %s", strings.Join(rejected, ", ")))
+	}
+
+	return stored, nil
+}
+
+// uploadedFiles returns the files of the field of the form, or the files of
+// all the fields, by name, when it has none, for clients using another name
+func uploadedFiles(form *multipart.Form, field string) []*multipart.FileHeader {
+	if files := form.File[field]; len(files) > 0 {
+		return files
+	}
+
+	names := make([]string, 0, len(form.File))
+	for name := range form.File {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	files := make([]*multipart.FileHeader, 0)
+	for _, name := range names {
+		files = append(files, form.File[name]...)
+	}
+	return files
+}
+
+// parseMultipartForm reads the multipart form of the request, keeping at most
+// the configured number of bytes of its files in memory, the rest going to
+// temporary files. The form is parsed once.
+func parseMultipartForm(c echo.Context, conf config) (*multipart.Form, error) {
+	req := c.Request()
+	if err := req.ParseMultipartForm(conf.MultipartMem); err != nil {
+		return nil, err
+	}
+	return req.MultipartForm, nil
+}
+
+// bufferForm returns a middleware parsing multipart forms with the memory
+// limit of the configuration, so that the next middleware reading a field
+// does not parse it with the default limit
+func bufferForm(conf config) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if strings.HasPrefix(c.Request().Header.Get(echo.HeaderContentType), echo.MIMEMultipartForm) {
+				if _, err := parseMultipartForm(c, conf); err != nil {
+					return multipartError(err)
+				}
+			}
+			return next(c)
+		}
+	}
+}
+
+// multipartError turns an error from the parsing of a multipart form into an
+// error with the status matching its cause: a request that is not a valid
+// multipart form or is too large is an error of the client, failing to
+// write the files to temporary storage an error of the server
+func multipartError(err error) error {
+	var he *echo.HTTPError
+	if errors.As(err, &he) {
+		return he
+	}
+
+	var pe *fs.PathError
+	switch {
+	case errors.Is(err, http.ErrNotMultipart), errors.Is(err, http.ErrMissingBoundary):
+		return echo.NewHTTPError(http.StatusBadRequest, "request is not a multipart/form-data form")
+	case errors.Is(err, multipart.ErrMessageTooLarge):
+		return echo.NewHTTPError(http.StatusRequestEntityTooLarge, "form fields are too large")
+	case errors.As(err, &pe):
+		return fmt.Errorf("could not read the form: %w", err)
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid multipart form: "+err.Error())
+	}
+}
+
+// uploadDir returns the directory where files uploaded to rel at t are
+// stored, according to the layout of the configuration. With the date layout,
+// the subdirectories of the day are created when missing.
+func uploadDir(conf config, st storage, rel string, t time.Time) (string, error) {
+	if conf.Layout != layoutDate {
+		return rel, nil
+	}
+
+	dir := path.Join(rel, t.Format("2006/01/02"))
+	if err := st.MkdirAll(dir); err != nil {
+		return "", fmt.Errorf("could not create %s: %w", dir, err)
+	}
+
+	return dir, nil
+}
+
+// storeFile writes the contents of src as the file name of the directory rel
+// of the storage, the name being already sanitized. The conflict strategy of
+// the configuration is applied when the file exists, false is returned when
+// the file is rejected for this reason. A protected file is never replaced.
+// The size is -1 when unknown.
+func storeFile(conf config, st storage, rel string, name string, src io.Reader, size int64) (storedFile, bool, error) {
+	// Concurrent uploads of the same name are stored one after the other
+	defer lockName(conf.StoreDir, path.Join(rel, name))()
+
+	exists := func(n string) bool {
+		_, err := st.Stat(path.Join(rel, n))
+		return err == nil
+	}
+
+	switch conf.OnConflict {
+	case conflictRename:
+		name = renameOnConflict(name, exists)
+	case conflictReject:
+		if exists(name) {
+			return storedFile{}, false, nil
+		}
+	}
+	p := path.Join(rel, name)
+
+	// Overwriting a protected file would remove its password
+	if exists(name) && isProtected(st, p) {
+		return storedFile{}, false, protectedConflict(name)
+	}
+
+	// The size is unknown when the file is streamed
+	cr := &countingReader{r: src}
+	if conf.indexDigests() {
+		if err := dedupWriteFile(conf.StoreDir, conf.TmpDir, conf.FilePerm, p, cr, conf.Dedup); err != nil {
+			return storedFile{}, false, err
+		}
+	} else if err := st.Put(p, cr, size); err != nil {
+		return storedFile{}, false, err
+	}
+
+	// An overwritten file loses the password of the previous one
+	if err := deleteMeta(st, p); err != nil {
+		return storedFile{}, false, err
+	}
+	uploadsTotal.Inc()
+	uploadBytesTotal.Add(float64(cr.n))
+
+	if conf.TTL > 0 {
+		uploadTimes(conf.StoreDir).record(p, time.Now())
+	}
+	downloadCounts(conf.StoreDir).reset(p)
+
+	return storedFile{
+		Name: name,
+		Path: p,
+		Size: cr.n,
+		URL:  fileURL(conf.BasePath, p),
+	}, true, nil
+}
+
+// fileURL returns the download URL of a file from its path relative to the
+// store directory
+func fileURL(basePath string, p string) string {
+	u := url.URL{Path: basePath + "/files/" + p}
+	return u.EscapedPath()
+}
+
+// writeFile atomically stores the contents of src in filename. The data is
+// first written to a temporary file in tmpDir, or in the same directory when
+// empty, which is moved to filename once complete, so that partial files
+// never appear in the store. The temporary file is given the mode perm before
+// being moved, so that the file has this mode as soon as it appears,
+// whatever the umask.
+func writeFile(filename string, tmpDir string, perm os.FileMode, src io.Reader) error {
+	if tmpDir == "" {
+		tmpDir = filepath.Dir(filename)
+	}
+
+	dst, err := os.CreateTemp(tmpDir, ".upl-*.part")
+	if err != nil {
+		return err
+	}
+	tmpName := dst.Name()
+
+	if err := copyAndSync(dst, src); err != nil {
+		dst.Close()
+		os.Remove(tmpName)
+		return err
+	}
+
+	if err := dst.Close(); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+
+	// CreateTemp makes files only readable by the owner
+	if err := os.Chmod(tmpName, perm); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+
+	if err := replaceFile(tmpName, filename); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+
+	return nil
+}
+
+// replaceFile moves the file src to filename. When they are on different
+// filesystems, src is copied atomically to filename, with the same mode, then
+// removed.
+func replaceFile(src string, filename string) error {
+	err := os.Rename(src, filename)
+	if err == nil || !isCrossDevice(err) {
+		return err
+	}
+
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if err := writeFile(filename, "", fi.Mode().Perm(), f); err != nil {
+		return err
+	}
+
+	return os.Remove(src)
+}
+
+// copyAndSync copies src to dst and flushes the data to disk
+func copyAndSync(dst *os.File, src io.Reader) error {
+	if _, err := io.Copy(dst, src); err != nil {
+		return err
+	}
+	return dst.Sync()
+}
+
+// renameOnConflict finds a free name for a file by appending " (1)", " (2)",
+// etc. before its extension. The exists function tells whether a name is
+// already taken.
+func renameOnConflict(name string, exists func(string) bool) string {
+	if !exists(name) {
+		return name
+	}
+
+	ext := filepath.Ext(name)
+	if ext == name {
+		// Dotfiles have no extension
+		ext = ""
+	}
+	base := strings.TrimSuffix(name, ext)
+
+	for i := 1; ; i++ {
+		candidate := fmt.Sprintf("%s (%d)%s", base, i, ext)
+		if !exists(candidate) {
+			return candidate
+		}
+	}
+}
+
+func deleteFile(c echo.Context, conf config) error {
+
+	st := storeStorage(conf)
+	rel, err := storageDir(st, c.FormValue("path"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+
+	filename, err := cleanFilename(c.FormValue("name"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if isReservedFile(filename) {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("reserved filename: %q", filename))
+	}
+
+	// The size of the file is kept for the audit log
+	fe, err := st.Stat(path.Join(rel, filename))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("no such file: %s", filename))
+	}
+
+	if err := checkChangePassword(c, st, path.Join(rel, filename)); err != nil {
+		return err
+	}
+
+	if err := st.Delete(path.Join(rel, filename)); err != nil {
+		if os.IsNotExist(err) {
+			return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("no such file: %s", filename))
+		}
+		return err
+	}
+	if err := deleteMeta(st, path.Join(rel, filename)); err != nil {
+		return err
+	}
+	audit(c, conf, auditDelete, path.Join(rel, filename), "", fe.Size)
+
+	if conf.TTL > 0 {
+		uploadTimes(conf.StoreDir).forget(path.Join(rel, filename))
+	}
+	downloadCounts(conf.StoreDir).reset(path.Join(rel, filename))
+	storeUsage(conf).invalidate()
+
+	return listFiles(c, conf)
+}
+
+// cleanFilename keeps only the base name of a filename sent by a client so
+// that it cannot point outside of the destination directory
+func cleanFilename(name string) (string, error) {
+	filename := filepath.Base(filepath.Clean(name))
+	if filename == "." || filename == "/" {
+		return "", fmt.Errorf("invalid filename")
+	}
+	return filename, nil
+}
+
+// A fileEntry is an item of a directory listing
+type fileEntry struct {
+	// Base name of the file
+	Name string `json:"name"`
+	// Slash separated path relative to the store directory
+	Path string `json:"path"`
+	// The entry is a subdirectory
+	IsDir bool `json:"is_dir"`
+	// Size in bytes and modification time, zero when unknown
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modtime"`
+	// Hex encoded SHA-256 digest, only computed when requested
+	SHA256 string `json:"sha256,omitempty"`
+	// When the file is removed, only when a TTL is configured
+	Expires *time.Time `json:"expires,omitempty"`
+	// Number of times the file was downloaded
+	Downloads int64 `json:"downloads"`
+	// A password is required to download the file
+	Protected bool `json:"protected"`
+	// Name sent by the client, time and address of the upload, only when
+	// the metadata of uploads are kept
+	OriginalName string     `json:"original_name,omitempty"`
+	UploadedAt   *time.Time `json:"uploaded_at,omitempty"`
+	ClientIP     string     `json:"client_ip,omitempty"`
+}
+
+// HumanSize returns the size of the entry in human readable units, empty for
+// directories and unknown sizes
+func (f fileEntry) HumanSize() string {
+	if f.IsDir || f.ModTime.IsZero() {
+		return ""
+	}
+	return bytes.Format(f.Size)
+}
+
+// ExpiresIn returns the time left before the file is removed, empty when it
+// does not expire
+func (f fileEntry) ExpiresIn() string {
+	if f.Expires == nil {
+		return ""
+	}
+
+	left := time.Until(*f.Expires)
+	if left < time.Minute {
+		return "< 1m"
+	}
+	return left.Truncate(time.Minute).String()
+}
+
+// FormattedModTime returns the modification time of the entry for display,
+// empty when unknown
+func (f fileEntry) FormattedModTime() string {
+	if f.ModTime.IsZero() {
+		return ""
+	}
+	return f.ModTime.Format("2006-01-02 15:04:05")
+}
+
+// listCurrentDir reads the contents of dir, rel is the path of dir relative to
+// the store directory, used to build the path of each entry. Symbolic links
+// are left out when skipSymlinks is true. An unreadable directory is an
+// error, not an empty listing.
+func listCurrentDir(dir string, rel string, skipSymlinks bool) ([]fileEntry, error) {
+	des, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	f := make([]fileEntry, 0, len(des))
 	for _, e := range des {
-		f = append(f, e.Name())
+		if skipSymlinks && e.Type()&fs.ModeSymlink != 0 {
+			continue
+		}
+
+		entry := fileEntry{
+			Name:  e.Name(),
+			Path:  path.Join(rel, e.Name()),
+			IsDir: e.IsDir(),
+		}
+
+		// The entry may have been removed since the directory was read,
+		// keep it with blank metadata
+		info, err := e.Info()
+		if err != nil {
+			log.Println("could not get file info:", err)
+		} else {
+			entry.Size = info.Size()
+			entry.ModTime = info.ModTime()
+		}
+
+		f = append(f, entry)
+	}
+	return f, nil
+}
+
+// addChecksums sets the SHA-256 digest of the regular files of a listing,
+// errors are logged and leave the digest empty
+func addChecksums(files []fileEntry, conf config) {
+	for i := range files {
+		if files[i].IsDir {
+			continue
+		}
+
+		sum, err := checksums.get(conf, files[i].Path)
+		if err != nil {
+			log.Println("could not compute checksum:", err)
+			continue
+		}
+		files[i].SHA256 = sum
+	}
+}
+
+// parentPath returns the relative path of the parent of rel, empty when it is
+// the root of the store
+func parentPath(rel string) string {
+	parent := path.Dir(rel)
+	if parent == "." {
+		return ""
 	}
-	return f
+	return parent
 }
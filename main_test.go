@@ -0,0 +1,332 @@
+// upl
+//
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// testConfig returns the default configuration with a store and caches in
+// temporary directories removed after the test
+func testConfig(t *testing.T) config {
+	t.Helper()
+
+	conf := newConfig()
+	conf.StoreDir = t.TempDir()
+	conf.ThumbDir = t.TempDir()
+	conf.CSRF = false
+	conf.NoAccessLog = true
+	return conf
+}
+
+// testServer starts the application with the configuration for the duration
+// of the test
+func testServer(t *testing.T, conf config) *httptest.Server {
+	t.Helper()
+
+	e, err := newServer(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		storagesMu.Lock()
+		defer storagesMu.Unlock()
+		for _, sc := range conf.storeConfigs() {
+			delete(storages, sc.StoreName)
+		}
+
+		diskUsagesMu.Lock()
+		defer diskUsagesMu.Unlock()
+		for _, sc := range conf.storeConfigs() {
+			delete(diskUsages, sc.StoreName)
+		}
+	})
+	ts := httptest.NewServer(e)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// A testPart is the file of a part of a multipart form sent by a test
+type testPart struct {
+	filename string
+	data     string
+	header   map[string]string
+}
+
+// postFiles sends the files in a multipart form to the URL, with header
+// added to the request
+func postFiles(t *testing.T, url string, field string, parts []testPart, header map[string]string) *http.Response {
+	t.Helper()
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, p := range parts {
+		h := make(textproto.MIMEHeader)
+		h.Set("Content-Disposition", `form-data; name="`+field+`"; filename="`+p.filename+`"`)
+		h.Set("Content-Type", "application/octet-stream")
+		for k, v := range p.header {
+			h.Set(k, v)
+		}
+		w, err := mw.CreatePart(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(w, p.data)
+	}
+	mw.Close()
+
+	req, err := http.NewRequest(http.MethodPost, url, &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { res.Body.Close() })
+	return res
+}
+
+// readStoreFile returns the contents of a file of the store, failing the
+// test when it cannot be read
+func readStoreFile(t *testing.T, conf config, name string) string {
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join(conf.StoreDir, filepath.FromSlash(name)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// storeEntries returns the names of the entries at the root of the store
+func storeEntries(t *testing.T, conf config) []string {
+	t.Helper()
+
+	entries, err := os.ReadDir(conf.StoreDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+func TestStoreFileFailingReader(t *testing.T) {
+	conf := testConfig(t)
+	st := storeStorage(conf)
+	boom := errors.New("connection reset")
+
+	if err := os.WriteFile(filepath.Join(conf.StoreDir, "a.txt"), []byte("previous"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	src := io.MultiReader(strings.NewReader("partial contents"), iotest.ErrReader(boom))
+	_, _, err := storeFile(conf, st, "", "a.txt", src, -1)
+	if !errors.Is(err, boom) {
+		t.Fatalf("got error %v, want %v", err, boom)
+	}
+
+	// The existing file is untouched and no partial file is left
+	if got := readStoreFile(t, conf, "a.txt"); got != "previous" {
+		t.Errorf("got contents %q after a failed upload", got)
+	}
+	if names := storeEntries(t, conf); len(names) != 1 {
+		t.Errorf("got entries %v after a failed upload", names)
+	}
+
+	// Streamed files give the name of the file in the error
+	src = io.MultiReader(strings.NewReader("partial contents"), iotest.ErrReader(boom))
+	_, _, err = streamFile(conf, st, "", src, "b.txt", "")
+	if !errors.Is(err, boom) || !strings.Contains(err.Error(), "b.txt") {
+		t.Errorf("got error %v for a streamed file", err)
+	}
+	if names := storeEntries(t, conf); len(names) != 1 {
+		t.Errorf("got entries %v after a failed streamed upload", names)
+	}
+}
+
+func TestMaxFiles(t *testing.T) {
+	for _, stream := range []bool{false, true} {
+		conf := testConfig(t)
+		conf.MaxFiles = 2
+		conf.StreamUploads = stream
+		ts := testServer(t, conf)
+
+		parts := make([]testPart, 0)
+		for i := 0; i < 3; i++ {
+			parts = append(parts, testPart{filename: fmt.Sprintf("file%d.txt", i), data: "x"})
+		}
+
+		res := postFiles(t, ts.URL+"/api/upload", conf.UploadField, parts, nil)
+		body, _ := io.ReadAll(res.Body)
+		if res.StatusCode != http.StatusBadRequest || !strings.Contains(string(body), "too many files") {
+			t.Errorf("stream=%v: got %d %s for 3 files", stream, res.StatusCode, body)
+		}
+
+		// Buffered forms are refused before writing any file, streamed
+		// ones keep the files before the limit
+		names := storeEntries(t, conf)
+		if !stream && len(names) != 0 {
+			t.Errorf("got entries %v after a refused upload", names)
+		}
+		if stream && len(names) != 2 {
+			t.Errorf("got entries %v after a refused streamed upload", names)
+		}
+
+		res = postFiles(t, ts.URL+"/api/upload", conf.UploadField, parts[:2], nil)
+		if res.StatusCode != http.StatusCreated {
+			t.Errorf("stream=%v: got %d for 2 files", stream, res.StatusCode)
+		}
+	}
+}
+
+func TestFilePerm(t *testing.T) {
+	if runtime.GOOS == "windows" || runtime.GOOS == "plan9" {
+		t.Skip("no Unix file modes on", runtime.GOOS)
+	}
+
+	// Modes wider than the usual umask of 022 show it is not applied
+	for _, perm := range []os.FileMode{0600, 0640, 0666} {
+		for _, stream := range []bool{false, true} {
+			conf := testConfig(t)
+			conf.FilePerm = perm
+			conf.StreamUploads = stream
+			ts := testServer(t, conf)
+
+			res := postFiles(t, ts.URL+"/api/upload", conf.UploadField, []testPart{{filename: "a.txt", data: "x"}}, nil)
+			if res.StatusCode != http.StatusCreated {
+				t.Fatalf("got status %d", res.StatusCode)
+			}
+
+			fi, err := os.Stat(filepath.Join(conf.StoreDir, "a.txt"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi.Mode().Perm() != perm {
+				t.Errorf("stream=%v: got mode %o, want %o", stream, fi.Mode().Perm(), perm)
+			}
+		}
+	}
+}
+
+func TestWriteFilePerm(t *testing.T) {
+	if runtime.GOOS == "windows" || runtime.GOOS == "plan9" {
+		t.Skip("no Unix file modes on", runtime.GOOS)
+	}
+
+	// The temporary file gets the mode before being moved, also from
+	// another directory
+	dir := t.TempDir()
+	for _, tmpDir := range []string{"", t.TempDir()} {
+		filename := filepath.Join(dir, "b.txt")
+		if err := writeFile(filename, tmpDir, 0604, strings.NewReader("x")); err != nil {
+			t.Fatal(err)
+		}
+		fi, err := os.Stat(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != 0604 {
+			t.Errorf("tmpDir=%q: got mode %o", tmpDir, fi.Mode().Perm())
+		}
+	}
+}
+
+func TestUploadBodyLimit(t *testing.T) {
+	conf := testConfig(t)
+	if got := uploadBodyLimit(conf); got != 0 {
+		t.Errorf("got a body limit of %d without -max-size", got)
+	}
+
+	// Without -max-files, the body holds a single file
+	conf.MaxUploadSize = 1024
+	if got, want := uploadBodyLimit(conf), conf.MaxUploadSize+2*partOverhead; got != want {
+		t.Errorf("got a body limit of %d without -max-files, want %d", got, want)
+	}
+	ts := testServer(t, conf)
+	big := strings.Repeat("x", int(conf.MaxUploadSize))
+	res := postFiles(t, ts.URL+"/api/upload", conf.UploadField, []testPart{{filename: "a.txt", data: big}}, nil)
+	if res.StatusCode != http.StatusCreated {
+		t.Errorf("got %d for a file of the maximum size without -max-files", res.StatusCode)
+	}
+
+	// Bodies far over the limit are refused before being read
+	req, err := http.NewRequest(http.MethodPost, ts.URL+"/api/upload", strings.NewReader(strings.Repeat("x", 1<<20)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "multipart/form-data; boundary=x")
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("got %d for a large body without -max-files", res.StatusCode)
+	}
+}
+
+func TestUploadBodyLimitMaxFiles(t *testing.T) {
+	conf := testConfig(t)
+	conf.MaxUploadSize = 1024
+	conf.MaxFiles = 2
+	ts := testServer(t, conf)
+
+	// Files up to the maximum size pass despite the framing of the form
+	full := strings.Repeat("x", int(conf.MaxUploadSize))
+	parts := []testPart{{filename: "a.txt", data: full}, {filename: "b.txt", data: full}}
+	res := postFiles(t, ts.URL+"/api/upload", conf.UploadField, parts, nil)
+	if res.StatusCode != http.StatusCreated {
+		t.Errorf("got %d for files of the maximum size", res.StatusCode)
+	}
+
+	parts = []testPart{{filename: "c.txt", data: full + "x"}}
+	res = postFiles(t, ts.URL+"/api/upload", conf.UploadField, parts, nil)
+	if res.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("got %d for a file over the maximum size", res.StatusCode)
+	}
+}
@@ -0,0 +1,297 @@
+// upl
+//
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/bcrypt"
+	"html/template"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// Suffix of the hidden sidecar files holding the metadata of the files of a
+// store, the sidecar of dir/name being dir/.name.upl.json
+const metaSuffix = ".upl.json"
+
+// A fileMeta holds what upl knows about a file besides its contents
+type fileMeta struct {
+	// Bcrypt hash of the password required to download the file, empty
+	// when the file is not protected
+	PasswordHash string `json:"password_hash,omitempty"`
+	// Name of the file sent by the client, before sanitization, when and
+	// from which address it was uploaded, only kept with KeepMetadata
+	OriginalName string     `json:"original_name,omitempty"`
+	UploadedAt   *time.Time `json:"uploaded_at,omitempty"`
+	ClientIP     string     `json:"client_ip,omitempty"`
+}
+
+// metaPath returns the path of the sidecar of the file p
+func metaPath(p string) string {
+	dir, name := path.Split(p)
+	return path.Join(dir, "."+name+metaSuffix)
+}
+
+// isMetaFile tells if a name is the one of a sidecar file
+func isMetaFile(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.HasSuffix(name, metaSuffix) && len(name) > 1+len(metaSuffix)
+}
+
+// loadMeta reads the metadata of the file p, a file without a sidecar has
+// empty metadata
+func loadMeta(st storage, p string) (fileMeta, error) {
+	var m fileMeta
+
+	f, err := st.Open(metaPath(p))
+	if errors.Is(err, fs.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return m, err
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return m, err
+	}
+
+	err = json.Unmarshal(data, &m)
+	return m, err
+}
+
+// saveMeta writes the sidecar of the file p
+func saveMeta(st storage, p string, m fileMeta) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	return st.Put(metaPath(p), bytes.NewReader(data), int64(len(data)))
+}
+
+// saveUploadMeta writes the sidecar of the uploaded file p, with the metadata
+// m and, when the configuration keeps them, the original name of the file,
+// the time of the upload and the address of the client. No sidecar is
+// written when there is nothing to keep.
+func saveUploadMeta(c echo.Context, conf config, st storage, p string, m fileMeta, original string) error {
+	if conf.KeepMetadata {
+		now := time.Now()
+		m.OriginalName = original
+		m.UploadedAt = &now
+		m.ClientIP = c.RealIP()
+	}
+
+	if m == (fileMeta{}) {
+		return nil
+	}
+	return saveMeta(st, p, m)
+}
+
+// deleteMeta removes the sidecar of the file p, if any
+func deleteMeta(st storage, p string) error {
+	err := st.Delete(metaPath(p))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// moveMeta renames the sidecar of a file renamed from oldName to newName, if
+// any
+func moveMeta(st storage, oldName string, newName string) error {
+	if _, err := st.Stat(metaPath(oldName)); err != nil {
+		return nil
+	}
+	return st.Rename(metaPath(oldName), metaPath(newName))
+}
+
+// splitMetaFiles removes the sidecars from the entries of a directory, it
+// returns the names of the files having one
+func splitMetaFiles(files []fileEntry) ([]fileEntry, map[string]bool) {
+	withMeta := make(map[string]bool)
+	kept := files[:0]
+	for _, f := range files {
+		if !f.IsDir && isMetaFile(f.Name) {
+			withMeta[strings.TrimSuffix(strings.TrimPrefix(f.Name, "."), metaSuffix)] = true
+			continue
+		}
+		kept = append(kept, f)
+	}
+
+	return kept, withMeta
+}
+
+// addMetadata marks the entries of the directory rel protected by a
+// password, withMeta giving the names of the files having a sidecar. With
+// keepMetadata, the upload information of the sidecar is added too.
+func addMetadata(files []fileEntry, st storage, rel string, withMeta map[string]bool, keepMetadata bool) {
+	for i := range files {
+		if !withMeta[files[i].Name] {
+			continue
+		}
+		m, err := loadMeta(st, path.Join(rel, files[i].Name))
+		if err != nil {
+			continue
+		}
+		files[i].Protected = m.PasswordHash != ""
+		if keepMetadata {
+			files[i].OriginalName = m.OriginalName
+			files[i].UploadedAt = m.UploadedAt
+			files[i].ClientIP = m.ClientIP
+		}
+	}
+}
+
+// UploadInfo describes how the file of the entry was uploaded, from the
+// metadata kept, empty without them
+func (f fileEntry) UploadInfo() string {
+	if f.UploadedAt == nil {
+		return ""
+	}
+
+	info := fmt.Sprintf("Uploaded on %s", f.UploadedAt.Format("2006-01-02 15:04:05"))
+	if f.OriginalName != "" && f.OriginalName != f.Name {
+		info = fmt.Sprintf("Uploaded as %s on %s", f.OriginalName, f.UploadedAt.Format("2006-01-02 15:04:05"))
+	}
+	if f.ClientIP != "" {
+		info += " from " + f.ClientIP
+	}
+	return info
+}
+
+// Name of the form field giving the password of a file, on upload and on
+// download
+const passwordField = "password"
+
+// passwordMeta returns the metadata protecting a file with the password,
+// none when it is empty
+func passwordMeta(pass string) (fileMeta, error) {
+	if pass == "" {
+		return fileMeta{}, nil
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.DefaultCost)
+	if err != nil {
+		return fileMeta{}, echo.NewHTTPError(http.StatusBadRequest, "invalid password: "+err.Error())
+	}
+
+	return fileMeta{PasswordHash: string(hash)}, nil
+}
+
+// checkFilePassword verifies the password posted in the request when the
+// file p is protected by one. Otherwise, browsers get a form asking for the
+// password, and other clients an error, both with the 401 status.
+func checkFilePassword(c echo.Context, conf config, st storage, p string) error {
+	m, err := loadMeta(st, p)
+	if err != nil {
+		return err
+	}
+	if m.PasswordHash == "" {
+		return nil
+	}
+
+	pass := ""
+	if c.Request().Method == http.MethodPost {
+		pass = c.FormValue(passwordField)
+		if bcrypt.CompareHashAndPassword([]byte(m.PasswordHash), []byte(pass)) == nil {
+			return nil
+		}
+	}
+
+	msg := "this file is protected by a password"
+	if pass != "" {
+		msg = "wrong password"
+	}
+
+	if !strings.Contains(c.Request().Header.Get(echo.HeaderAccept), echo.MIMETextHTML) {
+		return echo.NewHTTPError(http.StatusUnauthorized, msg)
+	}
+
+	return c.Render(http.StatusUnauthorized, "password.html", passwordView{
+		Root:    conf.RootPath,
+		Title:   conf.Title,
+		Footer:  template.HTML(conf.Footer),
+		Name:    path.Base(p),
+		Field:   passwordField,
+		Message: msg,
+	})
+}
+
+// isProtected tells if the file p has a password, a sidecar that cannot be
+// read counts as one
+func isProtected(st storage, p string) bool {
+	m, err := loadMeta(st, p)
+	return err != nil || m.PasswordHash != ""
+}
+
+// protectedConflict returns the error of a request replacing the protected
+// file name, which has to be deleted with its password first
+func protectedConflict(name string) *echo.HTTPError {
+	return echo.NewHTTPError(http.StatusConflict,
+		fmt.Sprintf("%s is protected by a password, delete it first", name))
+}
+
+// checkChangePassword verifies the password posted with a request modifying
+// the file p when it is protected by one, so that the protection cannot be
+// removed by deleting, renaming or moving the file without it
+func checkChangePassword(c echo.Context, st storage, p string) error {
+	m, err := loadMeta(st, p)
+	if err != nil {
+		return err
+	}
+	if m.PasswordHash == "" {
+		return nil
+	}
+
+	pass := c.FormValue(passwordField)
+	if pass == "" {
+		return echo.NewHTTPError(http.StatusUnauthorized, "this file is protected by a password")
+	}
+	if bcrypt.CompareHashAndPassword([]byte(m.PasswordHash), []byte(pass)) != nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, "wrong password")
+	}
+
+	return nil
+}
+
+// A passwordView holds the data used to render the password form
+type passwordView struct {
+	Root    string
+	Title   string
+	Footer  template.HTML
+	Name    string
+	Field   string
+	Message string
+}
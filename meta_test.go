@@ -0,0 +1,159 @@
+// upl
+//
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// protectFile creates the file name of the store protected by the password
+func protectFile(t *testing.T, conf config, name string, data string, password string) {
+	t.Helper()
+
+	if err := os.WriteFile(filepath.Join(conf.StoreDir, filepath.FromSlash(name)), []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := saveMeta(storeStorage(conf), name, fileMeta{PasswordHash: string(hash)}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUploadOverProtected(t *testing.T) {
+	for _, stream := range []bool{false, true} {
+		conf := testConfig(t)
+		conf.StreamUploads = stream
+		ts := testServer(t, conf)
+		protectFile(t, conf, "p.txt", "original", "secret")
+
+		res := postFiles(t, ts.URL+"/api/upload", conf.UploadField, []testPart{{filename: "p.txt", data: "replaced"}}, nil)
+		if res.StatusCode != http.StatusConflict {
+			t.Errorf("stream=%v: got status %d", stream, res.StatusCode)
+		}
+		if got := readStoreFile(t, conf, "p.txt"); got != "original" {
+			t.Errorf("stream=%v: protected file replaced by %q", stream, got)
+		}
+		if !isProtected(storeStorage(conf), "p.txt") {
+			t.Errorf("stream=%v: password removed", stream)
+		}
+
+		// Once deleted with its password, the name can be used again
+		res, err := http.PostForm(ts.URL+"/delete", url.Values{"name": {"p.txt"}, passwordField: {"secret"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("stream=%v: got status %d for the deletion", stream, res.StatusCode)
+		}
+		res = postFiles(t, ts.URL+"/api/upload", conf.UploadField, []testPart{{filename: "p.txt", data: "replaced"}}, nil)
+		if res.StatusCode != http.StatusCreated {
+			t.Errorf("stream=%v: got status %d after the deletion", stream, res.StatusCode)
+		}
+	}
+}
+
+func TestUploadOverProtectedRename(t *testing.T) {
+	conf := testConfig(t)
+	conf.OnConflict = conflictRename
+	ts := testServer(t, conf)
+	protectFile(t, conf, "p.txt", "original", "secret")
+
+	res := postFiles(t, ts.URL+"/api/upload", conf.UploadField, []testPart{{filename: "p.txt", data: "new"}}, nil)
+	if res.StatusCode != http.StatusCreated {
+		t.Errorf("got status %d", res.StatusCode)
+	}
+	if got := readStoreFile(t, conf, "p.txt"); got != "original" {
+		t.Errorf("protected file replaced by %q", got)
+	}
+	if got := readStoreFile(t, conf, "p (1).txt"); got != "new" {
+		t.Errorf("got %q for the renamed upload", got)
+	}
+}
+
+func TestResumableOverProtected(t *testing.T) {
+	conf := testConfig(t)
+	ts := testServer(t, conf)
+	protectFile(t, conf, "p.txt", "original", "secret")
+
+	req, err := http.NewRequest(http.MethodPut, ts.URL+"/files/p.txt", strings.NewReader("replaced"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusConflict {
+		t.Errorf("got status %d", res.StatusCode)
+	}
+	if got := readStoreFile(t, conf, "p.txt"); got != "original" {
+		t.Errorf("protected file replaced by %q", got)
+	}
+}
+
+func TestRenameOverProtected(t *testing.T) {
+	conf := testConfig(t)
+	ts := testServer(t, conf)
+	protectFile(t, conf, "p.txt", "original", "secret")
+	if err := os.WriteFile(filepath.Join(conf.StoreDir, "other.txt"), []byte("other"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The password of the source does not matter, the target is protected
+	for _, pass := range []string{"", "secret"} {
+		res, err := http.PostForm(ts.URL+"/rename", url.Values{
+			"old": {"other.txt"}, "new": {"p.txt"}, "overwrite": {"1"}, passwordField: {pass},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusConflict {
+			t.Errorf("password %q: got status %d", pass, res.StatusCode)
+		}
+	}
+
+	if got := readStoreFile(t, conf, "p.txt"); got != "original" {
+		t.Errorf("protected file replaced by %q", got)
+	}
+	if got := readStoreFile(t, conf, "other.txt"); got != "other" {
+		t.Errorf("source file changed to %q", got)
+	}
+	if !isProtected(storeStorage(conf), "p.txt") {
+		t.Errorf("password removed")
+	}
+}
@@ -0,0 +1,103 @@
+// upl
+//
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A router registers routes, either an echo instance or a group
+type router interface {
+	GET(path string, h echo.HandlerFunc, m ...echo.MiddlewareFunc) *echo.Route
+	HEAD(path string, h echo.HandlerFunc, m ...echo.MiddlewareFunc) *echo.Route
+}
+
+// getRoute registers h on p for GET requests and for HEAD requests, which get
+// the same headers without the body
+func getRoute(r router, p string, h echo.HandlerFunc, m ...echo.MiddlewareFunc) {
+	r.GET(p, h, m...)
+	r.HEAD(p, h, m...)
+}
+
+// allowMethods returns a middleware answering requests with a method not
+// registered on their route: OPTIONS requests get a 204 and the others a 405,
+// both with the Allow header listing the methods of the route. It runs
+// before authentication, CORS preflight requests do not have credentials. The
+// methods are collected from the routes of e on the first request.
+func allowMethods(e *echo.Echo) echo.MiddlewareFunc {
+	var (
+		once    sync.Once
+		methods map[string]map[string]bool
+	)
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			once.Do(func() { methods = routeMethods(e) })
+
+			route := c.Path()
+			allowed, ok := methods[route]
+			method := c.Request().Method
+			if !ok || allowed[method] {
+				return next(c)
+			}
+
+			c.Response().Header().Set(echo.HeaderAllow, allowHeader(allowed))
+			if method == http.MethodOptions {
+				return c.NoContent(http.StatusNoContent)
+			}
+			return echo.ErrMethodNotAllowed
+		}
+	}
+}
+
+// routeMethods returns the methods registered on each route path of e
+func routeMethods(e *echo.Echo) map[string]map[string]bool {
+	methods := make(map[string]map[string]bool)
+	for _, r := range e.Routes() {
+		if methods[r.Path] == nil {
+			methods[r.Path] = make(map[string]bool)
+		}
+		methods[r.Path][r.Method] = true
+	}
+	return methods
+}
+
+// allowHeader returns the value of the Allow header for the methods of a
+// route, OPTIONS being always answered
+func allowHeader(allowed map[string]bool) string {
+	list := []string{http.MethodOptions}
+	for m := range allowed {
+		if m != http.MethodOptions {
+			list = append(list, m)
+		}
+	}
+	sort.Strings(list)
+	return strings.Join(list, ", ")
+}
@@ -0,0 +1,111 @@
+// upl
+//
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	uploadsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "upl_uploads_total",
+		Help: "Number of files uploaded.",
+	})
+
+	uploadBytesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "upl_upload_bytes_total",
+		Help: "Number of bytes received in uploaded files.",
+	})
+
+	uploadDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "upl_upload_duration_seconds",
+		Help:    "Time spent handling upload requests.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 4, 10),
+	})
+
+	downloadsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "upl_downloads_total",
+		Help: "Number of files served.",
+	})
+)
+
+// registerStoreMetrics registers the gauge of the number of files in the
+// stores, which is computed on each scrape
+func registerStoreMetrics(stores []config) error {
+	g := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "upl_files",
+		Help: "Number of files in the store directories.",
+	}, func() float64 {
+		n := 0
+		for _, sc := range stores {
+			n += countFiles(sc.StoreDir)
+		}
+		return float64(n)
+	})
+
+	if err := prometheus.Register(g); err != nil {
+		if _, ok := err.(prometheus.AlreadyRegisteredError); !ok {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// countFiles returns the number of regular files under dir, unreadable parts
+// of the tree are ignored
+func countFiles(dir string) int {
+	n := 0
+	filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err == nil && d.Type().IsRegular() {
+			n++
+		}
+		return nil
+	})
+	return n
+}
+
+// countDownloads is a middleware incrementing the downloads counter when a
+// file of a store is successfully served
+func countDownloads(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		err := next(c)
+		route := c.Path()
+		if err == nil && c.Request().Method == http.MethodGet &&
+			(strings.HasSuffix(route, "/files/*") || strings.HasSuffix(route, "/files/:name")) {
+			if s := c.Response().Status; s >= 200 && s < 300 {
+				downloadsTotal.Inc()
+			}
+		}
+		return err
+	}
+}
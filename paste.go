@@ -0,0 +1,116 @@
+// upl
+//
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/bytes"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// Layout of the time in the names of pastes sent without a name
+const pasteTimeLayout = "20060102-150405"
+
+// pasteText stores the contents of the text field as a text file named after
+// the name field, or the current time when it is empty. The file is handled
+// like uploads.
+func pasteText(c echo.Context, conf config) error {
+
+	start := time.Now()
+	defer func() { uploadDuration.Observe(time.Since(start).Seconds()) }()
+
+	text := c.FormValue("text")
+	if text == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "missing text")
+	}
+
+	size := int64(len(text))
+	if conf.MaxUploadSize > 0 && size > conf.MaxUploadSize {
+		return echo.NewHTTPError(http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("text is too large: maximum upload size is %s", bytes.Format(conf.MaxUploadSize)))
+	}
+
+	st := storeStorage(conf)
+	rel, err := storageDir(st, c.FormValue("path"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+
+	name := strings.TrimSpace(c.FormValue("name"))
+	if name == "" {
+		name = "paste-" + start.Format(pasteTimeLayout)
+	}
+
+	name, err = sanitizeFilename(name, conf)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if path.Ext(name) == "" {
+		name += ".txt"
+	}
+
+	if err := checkExtension(name, conf); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	release, err := reserveQuota(conf, size)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if err := sniffUpload(conf, name, strings.NewReader(text)); err != nil {
+		return err
+	}
+
+	if err := scanUpload(conf, name, strings.NewReader(text)); err != nil {
+		return err
+	}
+
+	rel, err = uploadDir(conf, st, rel, time.Now())
+	if err != nil {
+		return err
+	}
+
+	sf, ok, err := storeFile(conf, st, rel, name, strings.NewReader(text), size)
+	if err != nil {
+		return storeError(name, err)
+	}
+	if !ok {
+		return echo.NewHTTPError(http.StatusConflict, fmt.Sprintf("file already exists: %s", name))
+	}
+	if err := saveUploadMeta(c, conf, st, sf.Path, fileMeta{}, sf.Name); err != nil {
+		return fmt.Errorf("could not save the metadata of %s: %w", sf.Name, err)
+	}
+	audit(c, conf, auditUpload, sf.Path, "", sf.Size)
+	runPostUpload(conf, sf.Path, name)
+
+	return listFiles(c, conf)
+}
@@ -0,0 +1,189 @@
+// upl
+//
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bytes"
+	"github.com/labstack/echo/v4"
+	"github.com/yuin/goldmark"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"unicode/utf8"
+)
+
+// Maximum size of the files rendered by the preview
+const previewMaxSize = 1 << 20
+
+// Extensions of the files that can be previewed, markdown is rendered to
+// HTML, other files are shown as text
+var previewExts = map[string]bool{
+	".txt": false,
+	".log": false,
+	".md":  true,
+}
+
+// Previewable tells if the entry is a file that can be shown in the preview
+// page instead of being downloaded
+func (f fileEntry) Previewable() bool {
+	_, ok := previewExts[strings.ToLower(path.Ext(f.Name))]
+	return ok && !f.IsDir && !f.Protected && f.Size <= previewMaxSize
+}
+
+// preview renders a text or markdown file of the store inside the layout.
+// Other files, binary contents and files too large are redirected to the
+// download URL.
+func preview(c echo.Context, conf config) error {
+
+	st := storeStorage(conf)
+	rel, err := storageDir(st, c.QueryParam("path"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+
+	name, err := cleanFilename(c.Param("name"))
+	if err != nil || isReservedFile(name) {
+		return echo.NotFoundHandler(c)
+	}
+	p := path.Join(rel, name)
+
+	fe, err := st.Stat(p)
+	if err != nil || fe.IsDir {
+		return echo.NotFoundHandler(c)
+	}
+
+	// The download asks for the password of protected files
+	download := fileURL(conf.BasePath, p)
+	if m, err := loadMeta(st, p); err != nil || m.PasswordHash != "" {
+		return c.Redirect(http.StatusFound, download)
+	}
+
+	markdown, ok := previewExts[strings.ToLower(path.Ext(name))]
+	if !ok || fe.Size > previewMaxSize {
+		return c.Redirect(http.StatusFound, download)
+	}
+
+	f, err := st.Open(p)
+	if err != nil {
+		return echo.NotFoundHandler(c)
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(io.LimitReader(f, previewMaxSize+1))
+	if err != nil {
+		return err
+	}
+	if len(data) > previewMaxSize || !utf8.Valid(data) || bytes.IndexByte(data, 0) != -1 {
+		return c.Redirect(http.StatusFound, download)
+	}
+
+	v := previewView{
+		Root:        conf.RootPath,
+		BasePath:    conf.BasePath,
+		Title:       conf.Title,
+		Footer:      template.HTML(conf.Footer),
+		Name:        name,
+		Path:        rel,
+		DownloadURL: download,
+	}
+
+	if markdown {
+		v.HTML, err = renderMarkdown(data)
+		if err != nil {
+			return err
+		}
+	} else {
+		v.Text = string(data)
+	}
+
+	return c.Render(http.StatusOK, "preview.html", v)
+}
+
+// renderMarkdown converts markdown to HTML. The renderer omits raw HTML and
+// unsafe links, so that files cannot inject scripts in the pages.
+func renderMarkdown(data []byte) (template.HTML, error) {
+	var buf bytes.Buffer
+	if err := goldmark.Convert(data, &buf); err != nil {
+		return "", err
+	}
+	return template.HTML(buf.String()), nil
+}
+
+// Names of the markdown files describing a directory, shown above its
+// listing, by order of preference
+var descriptionFiles = []string{"README.md", ".upl-description"}
+
+// loadDescription renders the description file of the directory rel, it is
+// empty when there is none or it cannot be read
+func loadDescription(st storage, rel string) template.HTML {
+	for _, name := range descriptionFiles {
+		p := path.Join(rel, name)
+		fe, err := st.Stat(p)
+		if err != nil || fe.IsDir || fe.Size > previewMaxSize {
+			continue
+		}
+		if m, err := loadMeta(st, p); err != nil || m.PasswordHash != "" {
+			continue
+		}
+
+		f, err := st.Open(p)
+		if err != nil {
+			continue
+		}
+		data, err := io.ReadAll(io.LimitReader(f, previewMaxSize))
+		f.Close()
+		if err != nil || !utf8.Valid(data) {
+			continue
+		}
+
+		html, err := renderMarkdown(data)
+		if err != nil {
+			log.Println("could not render description:", err)
+			continue
+		}
+		return html
+	}
+
+	return ""
+}
+
+// A previewView holds the data used to render the preview of a file
+type previewView struct {
+	Root     string
+	BasePath string
+	Title    string
+	Footer   template.HTML
+	Name     string
+	// Directory of the file, to go back to the listing
+	Path        string
+	DownloadURL string
+	// Rendered markdown or contents of a text file, only one is set
+	HTML template.HTML
+	Text string
+}
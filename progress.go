@@ -0,0 +1,195 @@
+// upl
+//
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Header tagging an upload to follow its progress on /progress/:id
+const uploadIDHeader = "X-Upload-Id"
+
+// Maximum length of an upload id
+const maxUploadIDLen = 128
+
+// How often progress events are sent
+const progressInterval = 500 * time.Millisecond
+
+// An uploadProgress counts the bytes received for an upload
+type uploadProgress struct {
+	// Accessed atomically, first for alignment
+	read  int64
+	total int64
+	// Set when the upload has begun and closed when it is over
+	started bool
+	done    chan struct{}
+	// Number of uploads and watchers using the entry, guarded by the
+	// mutex of the registry
+	refs int
+}
+
+// Progress of the uploads tagged with an id, the entries are created by the
+// first of the upload or of a watcher and removed when both are gone
+var (
+	uploadProgressMu sync.Mutex
+	uploadProgresses = make(map[string]*uploadProgress)
+)
+
+// acquireProgress returns the progress of the upload id, created when
+// missing, it must be released when done with it
+func acquireProgress(id string) *uploadProgress {
+	uploadProgressMu.Lock()
+	defer uploadProgressMu.Unlock()
+
+	p, ok := uploadProgresses[id]
+	if !ok {
+		p = &uploadProgress{done: make(chan struct{})}
+		uploadProgresses[id] = p
+	}
+	p.refs++
+
+	return p
+}
+
+// releaseProgress forgets the progress of the upload id once nothing uses
+// it anymore
+func releaseProgress(id string, p *uploadProgress) {
+	uploadProgressMu.Lock()
+	defer uploadProgressMu.Unlock()
+
+	p.refs--
+	if p.refs == 0 && uploadProgresses[id] == p {
+		delete(uploadProgresses, id)
+	}
+}
+
+// A progressReader counts the bytes read from the body of an upload
+type progressReader struct {
+	io.ReadCloser
+	p *uploadProgress
+}
+
+func (pr progressReader) Read(b []byte) (int, error) {
+	n, err := pr.ReadCloser.Read(b)
+	atomic.AddInt64(&pr.p.read, int64(n))
+	return n, err
+}
+
+// trackProgress is a middleware counting the bytes received by the uploads
+// tagged with an id
+func trackProgress(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		id := c.Request().Header.Get(uploadIDHeader)
+		if id == "" {
+			return next(c)
+		}
+		if len(id) > maxUploadIDLen {
+			return echo.NewHTTPError(http.StatusBadRequest, "upload id is too long")
+		}
+
+		p := acquireProgress(id)
+		defer releaseProgress(id, p)
+
+		uploadProgressMu.Lock()
+		started := p.started
+		p.started = true
+		uploadProgressMu.Unlock()
+		if started {
+			return echo.NewHTTPError(http.StatusConflict, "upload id already in use: "+id)
+		}
+		defer close(p.done)
+
+		atomic.StoreInt64(&p.total, c.Request().ContentLength)
+		c.Request().Body = progressReader{ReadCloser: c.Request().Body, p: p}
+
+		return next(c)
+	}
+}
+
+// A progressEvent is the data of the events sent to watchers
+type progressEvent struct {
+	Read int64 `json:"read"`
+	// Size of the request, -1 when unknown
+	Total int64 `json:"total"`
+}
+
+// uploadProgressEvents streams the number of bytes received by the upload
+// of the id as server-sent events, until the upload is over or the client
+// goes away. The upload may start after the client is connected.
+func uploadProgressEvents(c echo.Context, conf config) error {
+	id := c.Param("id")
+	if id == "" || len(id) > maxUploadIDLen {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid upload id")
+	}
+
+	p := acquireProgress(id)
+	defer releaseProgress(id, p)
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.WriteHeader(http.StatusOK)
+
+	send := func(event string) error {
+		data, err := json.Marshal(progressEvent{
+			Read:  atomic.LoadInt64(&p.read),
+			Total: atomic.LoadInt64(&p.total),
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(res, "event: %s\ndata: %s\n\n", event, data); err != nil {
+			return err
+		}
+		res.Flush()
+		return nil
+	}
+
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := send("progress"); err != nil {
+			return nil
+		}
+
+		select {
+		case <-p.done:
+			send("done")
+			return nil
+		case <-c.Request().Context().Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,91 @@
+// upl
+//
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// parseNetworks splits a comma separated list of IP addresses and CIDR
+// networks
+func parseNetworks(s string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0)
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, fmt.Errorf("%s is not an IP address or network", v)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not an IP address or network", v)
+		}
+		nets = append(nets, n)
+	}
+
+	return nets, nil
+}
+
+// proxyIPExtractor gets the IP address of clients from the X-Forwarded-For
+// header, skipping the addresses of the proxies. Loopback, link-local and
+// private addresses are trusted as proxies, as well as the extra networks of
+// the configuration. Connections on a Unix socket always come from a local
+// proxy.
+func proxyIPExtractor(conf config) echo.IPExtractor {
+	nets, _ := parseNetworks(strings.Join(conf.TrustedProxies, ","))
+	opts := make([]echo.TrustOption, 0, len(nets))
+	for _, n := range nets {
+		opts = append(opts, echo.TrustIPRange(n))
+	}
+	xff := echo.ExtractIPFromXFFHeader(opts...)
+
+	return func(req *http.Request) string {
+		if _, _, err := net.SplitHostPort(req.RemoteAddr); err != nil {
+			r := *req
+			r.RemoteAddr = "127.0.0.1:0"
+			return xff(&r)
+		}
+		return xff(req)
+	}
+}
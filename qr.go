@@ -0,0 +1,89 @@
+// upl
+//
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"github.com/labstack/echo/v4"
+	"github.com/skip2/go-qrcode"
+	"net/http"
+	"path"
+)
+
+// Width and height of QR code images in pixels
+const qrSize = 256
+
+// fileQR returns a PNG image of a QR code encoding the absolute download URL
+// of a file, to open it on a phone. With a secret, the URL is a signed link
+// valid for the duration of the ttl query parameter, so that the phone needs
+// no credentials.
+func fileQR(c echo.Context, conf config) error {
+	st := storeStorage(conf)
+	rel, err := storageDir(st, c.QueryParam("path"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+
+	name, err := cleanFilename(c.Param("name"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+	if isReservedFile(name) {
+		return echo.NewHTTPError(http.StatusNotFound, "no such file: "+name)
+	}
+	p := path.Join(rel, name)
+
+	fe, err := st.Stat(p)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "no such file: "+name)
+	}
+
+	// The route shadows files named qr at the first level of
+	// subdirectories, serve them as the download handler would
+	if fe.IsDir {
+		if rel != "" {
+			return echo.NewHTTPError(http.StatusNotFound, "no such file: "+name)
+		}
+		return serveStoreFile(c, conf, path.Join(p, "qr"))
+	}
+
+	u := absoluteURL(c, fileURL(conf.BasePath, p))
+	if conf.Secret != "" {
+		ttl, err := shareTTL(c)
+		if err != nil {
+			return err
+		}
+		u = signedURL(c, conf, p, ttl)
+	}
+
+	png, err := qrcode.Encode(u, qrcode.Medium, qrSize)
+	if err != nil {
+		return err
+	}
+
+	// Signed links expire
+	c.Response().Header().Set("Cache-Control", "no-store")
+	return c.Blob(http.StatusOK, "image/png", png)
+}
@@ -0,0 +1,208 @@
+// upl
+//
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/bytes"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+)
+
+// How long the disk usage of a store is trusted, to account for changes
+// made outside of the uploads and deletions of the web interface, like with
+// WebDAV
+const usageMaxAge = time.Minute
+
+// A diskUsage caches the number and total size of the files of a store,
+// with the size reserved by the uploads being stored
+type diskUsage struct {
+	mu       sync.Mutex
+	files    int
+	size     int64
+	reserved int64
+	computed time.Time
+}
+
+// Disk usages by store name
+var (
+	diskUsagesMu sync.Mutex
+	diskUsages   = make(map[string]*diskUsage)
+)
+
+// storeUsage returns the disk usage cache of the store of a handler
+func storeUsage(conf config) *diskUsage {
+	diskUsagesMu.Lock()
+	defer diskUsagesMu.Unlock()
+
+	du, ok := diskUsages[conf.StoreName]
+	if !ok {
+		du = &diskUsage{}
+		diskUsages[conf.StoreName] = du
+	}
+
+	return du
+}
+
+// get returns the total size of the files of the storage
+func (du *diskUsage) get(st storage) (int64, error) {
+	_, size, err := du.stats(st)
+	return size, err
+}
+
+// stats returns the number and the total size of the files of the storage,
+// walking the whole tree when the cached values are invalid or too old
+func (du *diskUsage) stats(st storage) (int, int64, error) {
+	du.mu.Lock()
+	defer du.mu.Unlock()
+
+	return du.compute(st)
+}
+
+// compute does the work of stats, with the lock held
+func (du *diskUsage) compute(st storage) (int, int64, error) {
+	if !du.computed.IsZero() && time.Since(du.computed) < usageMaxAge {
+		return du.files, du.size, nil
+	}
+
+	files, size, err := treeStats(st, "")
+	if err != nil {
+		return 0, 0, err
+	}
+
+	du.files = files
+	du.size = size
+	du.computed = time.Now()
+	return files, size, nil
+}
+
+// invalidate forces the computation of the usage on the next call to get,
+// after files are added or removed
+func (du *diskUsage) invalidate() {
+	du.mu.Lock()
+	du.computed = time.Time{}
+	du.mu.Unlock()
+}
+
+// treeStats returns the number and the total size of the files under dir,
+// including subdirectories
+func treeStats(st storage, dir string) (int, int64, error) {
+	entries, err := st.List(dir)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var (
+		files int
+		size  int64
+	)
+	for _, f := range entries {
+		if !f.IsDir {
+			files++
+			size += f.Size
+			continue
+		}
+
+		n, s, err := treeStats(st, path.Join(dir, f.Name))
+		if err != nil {
+			return 0, 0, err
+		}
+		files += n
+		size += s
+	}
+
+	return files, size, nil
+}
+
+// reserveQuota returns an error with the 507 status when adding size bytes
+// to the store would exceed the quota. Otherwise, the bytes are reserved
+// until the returned function is called, once the upload is stored, so that
+// concurrent uploads cannot exceed the quota together. The function always
+// forces the computation of the usage afterwards.
+func reserveQuota(conf config, size int64) (func(), error) {
+	du := storeUsage(conf)
+	if conf.Quota <= 0 {
+		return du.invalidate, nil
+	}
+
+	du.mu.Lock()
+	defer du.mu.Unlock()
+
+	_, used, err := du.compute(storeStorage(conf))
+	if err != nil {
+		return nil, err
+	}
+
+	if used+du.reserved+size > conf.Quota {
+		return nil, quotaError(used+du.reserved, conf.Quota)
+	}
+	du.reserved += size
+
+	return func() {
+		du.mu.Lock()
+		du.reserved -= size
+		du.computed = time.Time{}
+		du.mu.Unlock()
+	}, nil
+}
+
+// checkStoredQuota removes the file p, stored without knowing its size
+// beforehand, and returns an error with the 507 status when the quota is
+// exceeded with it
+func checkStoredQuota(conf config, st storage, p string) error {
+	if conf.Quota <= 0 {
+		return nil
+	}
+
+	du := storeUsage(conf)
+	du.mu.Lock()
+	defer du.mu.Unlock()
+
+	du.computed = time.Time{}
+	_, used, err := du.compute(st)
+	if err != nil {
+		return err
+	}
+
+	if used+du.reserved > conf.Quota {
+		if err := st.Delete(p); err != nil {
+			return err
+		}
+		du.computed = time.Time{}
+		return quotaError(used+du.reserved, conf.Quota)
+	}
+
+	return nil
+}
+
+// quotaError is the error of uploads exceeding the quota
+func quotaError(used int64, quota int64) *echo.HTTPError {
+	return echo.NewHTTPError(http.StatusInsufficientStorage,
+		fmt.Sprintf("not enough space left: %s used of %s", bytes.Format(used), bytes.Format(quota)))
+}
@@ -0,0 +1,140 @@
+// upl
+//
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestReserveQuota(t *testing.T) {
+	conf := testConfig(t)
+	conf.Quota = 100
+	t.Cleanup(func() {
+		diskUsagesMu.Lock()
+		delete(diskUsages, conf.StoreName)
+		diskUsagesMu.Unlock()
+	})
+
+	release, err := reserveQuota(conf, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The bytes of the first upload are counted until it is done
+	if _, err := reserveQuota(conf, 60); err == nil {
+		t.Errorf("reservations exceed the quota")
+	}
+	other, err := reserveQuota(conf, 40)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	release()
+	other()
+	release, err = reserveQuota(conf, 60)
+	if err != nil {
+		t.Errorf("released bytes still reserved: %s", err)
+	} else {
+		release()
+	}
+}
+
+func TestConcurrentUploadsQuota(t *testing.T) {
+	conf := testConfig(t)
+	conf.Quota = 100
+	ts := testServer(t, conf)
+
+	// Only one of the uploads fits, whatever their order
+	data := strings.Repeat("x", 60)
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		codes = make(map[int]int)
+	)
+	for _, name := range []string{"a.txt", "b.txt", "c.txt", "d.txt"} {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			res := postFiles(t, ts.URL+"/api/upload", conf.UploadField, []testPart{{filename: name, data: data}}, nil)
+			res.Body.Close()
+			mu.Lock()
+			codes[res.StatusCode]++
+			mu.Unlock()
+		}(name)
+	}
+	wg.Wait()
+
+	if codes[http.StatusCreated] != 1 || codes[http.StatusInsufficientStorage] != 3 {
+		t.Errorf("got statuses %v", codes)
+	}
+	if names := storeEntries(t, conf); len(names) != 1 {
+		t.Errorf("got entries %v", names)
+	}
+}
+
+func TestStreamedUploadQuota(t *testing.T) {
+	conf := testConfig(t)
+	conf.StreamUploads = true
+	conf.Quota = 100
+	ts := testServer(t, conf)
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, name := range []string{"a.txt", "b.txt"} {
+		w, err := mw.CreateFormFile(conf.UploadField, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(w, strings.Repeat("x", 60))
+	}
+	mw.Close()
+
+	// Without Content-Length, the file going over the quota is removed
+	// once stored
+	req, err := http.NewRequest(http.MethodPost, ts.URL+"/api/upload", io.MultiReader(&body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusInsufficientStorage {
+		t.Errorf("got status %d", res.StatusCode)
+	}
+	if names := storeEntries(t, conf); len(names) != 1 || names[0] != "a.txt" {
+		t.Errorf("got entries %v", names)
+	}
+}
@@ -0,0 +1,188 @@
+// upl
+//
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+)
+
+// renameFile gives the new name to the file named old in the directory of
+// the path field. The new name is sanitized like the names of uploads and
+// an existing file is only replaced when the overwrite field is true.
+func renameFile(c echo.Context, conf config) error {
+
+	st := storeStorage(conf)
+	rel, err := storageDir(st, c.FormValue("path"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+
+	oldName, err := cleanFilename(c.FormValue("old"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if isReservedFile(oldName) {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("reserved filename: %q", oldName))
+	}
+
+	newName, err := sanitizeFilename(c.FormValue("new"), conf)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	if err := checkExtension(newName, conf); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	overwrite, _ := strconv.ParseBool(c.FormValue("overwrite"))
+
+	from := path.Join(rel, oldName)
+	to := path.Join(rel, newName)
+
+	fe, err := st.Stat(from)
+	if err != nil || fe.IsDir {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("no such file: %s", oldName))
+	}
+
+	if err := checkChangePassword(c, st, from); err != nil {
+		return err
+	}
+
+	if from != to {
+		if _, err := st.Stat(to); err == nil && !overwrite {
+			return echo.NewHTTPError(http.StatusConflict, fmt.Sprintf("file already exists: %s", newName))
+		}
+
+		if err := moveStoreFile(conf, st, from, to); err != nil {
+			if os.IsNotExist(err) {
+				return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("no such file: %s", oldName))
+			}
+			return err
+		}
+		audit(c, conf, auditRename, from, to, fe.Size)
+	}
+
+	return listFiles(c, conf)
+}
+
+// moveFile moves the file of the name field from the directory of the path
+// field to the directory given by the dest field, relative to the root of
+// the store. The destination directory is created when missing and an
+// existing file is never replaced.
+func moveFile(c echo.Context, conf config) error {
+
+	st := storeStorage(conf)
+	rel, err := storageDir(st, c.FormValue("path"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+
+	name, err := cleanFilename(c.FormValue("name"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if isReservedFile(name) {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("reserved filename: %q", name))
+	}
+
+	dest, err := cleanRelPath(c.FormValue("dest"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	from := path.Join(rel, name)
+	to := path.Join(dest, name)
+
+	fe, err := st.Stat(from)
+	if err != nil || fe.IsDir {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("no such file: %s", name))
+	}
+
+	if err := checkChangePassword(c, st, from); err != nil {
+		return err
+	}
+
+	if from != to {
+		if de, err := st.Stat(dest); err == nil && !de.IsDir {
+			return echo.NewHTTPError(http.StatusConflict, fmt.Sprintf("not a directory: %s", dest))
+		}
+		if _, err := st.Stat(to); err == nil {
+			return echo.NewHTTPError(http.StatusConflict, fmt.Sprintf("file already exists: %s", to))
+		}
+
+		if err := st.MkdirAll(dest); err != nil {
+			return err
+		}
+
+		if err := moveStoreFile(conf, st, from, to); err != nil {
+			if os.IsNotExist(err) {
+				return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("no such file: %s", name))
+			}
+			return err
+		}
+		audit(c, conf, auditMove, from, to, fe.Size)
+	}
+
+	return listFiles(c, conf)
+}
+
+// moveStoreFile renames the file from to the path to, along with its
+// password, upload time and download count. A protected file is never
+// replaced.
+func moveStoreFile(conf config, st storage, from string, to string) error {
+	if _, err := st.Stat(to); err == nil && isProtected(st, to) {
+		return protectedConflict(path.Base(to))
+	}
+
+	if err := st.Rename(from, to); err != nil {
+		return err
+	}
+
+	// The password follows the file, the one of an overwritten file is
+	// dropped
+	if err := deleteMeta(st, to); err != nil {
+		return err
+	}
+	if err := moveMeta(st, from, to); err != nil {
+		return err
+	}
+
+	if conf.TTL > 0 {
+		uploadTimes(conf.StoreDir).move(from, to)
+	}
+	downloadCounts(conf.StoreDir).move(from, to)
+	if conf.indexDigests() {
+		dedupFiles(conf.StoreDir).move(from, to)
+	}
+	storeUsage(conf).invalidate()
+
+	return nil
+}
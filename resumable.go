@@ -0,0 +1,365 @@
+// upl
+//
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/bytes"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Header telling the client how many bytes of a resumable upload are stored
+const headerUploadOffset = "Upload-Offset"
+
+// partName returns the path of the partial file of a resumable upload of
+// filename. It is kept next to the destination so that the final rename does
+// not cross filesystems, unless a temporary directory is configured: the
+// name is then made unique from the path of the destination.
+func partName(tmpDir string, filename string) string {
+	if tmpDir != "" {
+		abs, err := filepath.Abs(filename)
+		if err != nil {
+			abs = filename
+		}
+		sum := sha256.Sum256([]byte(abs))
+		return filepath.Join(tmpDir, ".upl-"+hex.EncodeToString(sum[:16])+".part")
+	}
+	return filepath.Join(filepath.Dir(filename), "."+filepath.Base(filename)+".part")
+}
+
+// totalName returns the path of the file where the total size of the
+// resumable upload having the partial file part is kept, every request of
+// the upload must give the same
+func totalName(part string) string {
+	return filepath.Join(filepath.Dir(part), ".upl-"+filepath.Base(part)+".total")
+}
+
+// checkTotal records the total size of a resumable upload when its partial
+// file is created, and otherwise checks it is the one of the first request
+func checkTotal(part string, name string, total int64, created bool) error {
+	tf := totalName(part)
+	if !created {
+		data, err := os.ReadFile(tf)
+		if err == nil {
+			if t, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64); err == nil && t != total {
+				return echo.NewHTTPError(http.StatusConflict,
+					fmt.Sprintf("the upload of %s is of %d bytes, not %d", name, t, total))
+			}
+			return nil
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return os.WriteFile(tf, []byte(strconv.FormatInt(total, 10)), 0644)
+}
+
+// parseContentRange parses a Content-Range header of the form
+// "bytes start-end/total", the total size must be known
+func parseContentRange(h string) (int64, int64, int64, error) {
+	var start, end, total int64
+
+	spec := strings.TrimSpace(strings.TrimPrefix(h, "bytes"))
+	r, t, ok := cut(spec, "/")
+	if !ok || spec == h {
+		return 0, 0, 0, fmt.Errorf("invalid content range: %s", h)
+	}
+	s, e, ok := cut(r, "-")
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("invalid content range: %s", h)
+	}
+
+	var err error
+	if start, err = strconv.ParseInt(s, 10, 64); err != nil {
+		return 0, 0, 0, fmt.Errorf("invalid content range: %s", h)
+	}
+	if end, err = strconv.ParseInt(e, 10, 64); err != nil {
+		return 0, 0, 0, fmt.Errorf("invalid content range: %s", h)
+	}
+	if total, err = strconv.ParseInt(t, 10, 64); err != nil {
+		return 0, 0, 0, fmt.Errorf("invalid content range: %s", h)
+	}
+
+	if start < 0 || end < start || total <= end {
+		return 0, 0, 0, fmt.Errorf("invalid content range: %s", h)
+	}
+
+	return start, end, total, nil
+}
+
+// resumableTarget resolves the destination of a resumable upload from the
+// name parameter and the path query parameter, as a path of the store and as
+// the name of the file the upload is renamed to, resumable uploads only
+// working on the local filesystem
+func resumableTarget(c echo.Context, conf config, st storage) (string, string, error) {
+	rel, err := storageDir(st, c.QueryParam("path"))
+	if err != nil {
+		return "", "", echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+
+	name, err := sanitizeFilename(c.Param("name"), conf)
+	if err != nil {
+		return "", "", echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	if err := checkExtension(name, conf); err != nil {
+		return "", "", echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	p := path.Join(rel, name)
+	return p, filepath.Join(conf.StoreDir, filepath.FromSlash(p)), nil
+}
+
+// resumableStatus reports how many bytes of a file are stored when an upload
+// of it is in progress, with the size of its partial file. Other requests get
+// the headers of the download of the file.
+func resumableStatus(c echo.Context, conf config) error {
+
+	st := storeStorage(conf)
+	if _, filename, err := resumableTarget(c, conf, st); err == nil {
+		if fi, err := os.Stat(partName(conf.TmpDir, filename)); err == nil {
+			c.Response().Header().Set(headerUploadOffset, strconv.FormatInt(fi.Size(), 10))
+			return c.NoContent(http.StatusOK)
+		}
+	}
+
+	return serveFile(c, conf)
+}
+
+// resumableUpload stores the byte range of the request body in the partial
+// file of the upload. Ranges must start at most at the number of bytes
+// already received, so that the partial file has no holes. Once all bytes are
+// received, the partial file is renamed into place.
+func resumableUpload(c echo.Context, conf config) error {
+
+	st := storeStorage(conf)
+	p, filename, err := resumableTarget(c, conf, st)
+	if err != nil {
+		return err
+	}
+
+	req := c.Request()
+
+	var start, end, total int64
+	if cr := req.Header.Get("Content-Range"); cr != "" {
+		start, end, total, err = parseContentRange(cr)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+	} else {
+		// The whole file in one request
+		if req.ContentLength < 0 {
+			return echo.NewHTTPError(http.StatusLengthRequired, "missing Content-Length or Content-Range")
+		}
+		total = req.ContentLength
+		end = total - 1
+	}
+
+	if conf.MaxUploadSize > 0 && total > conf.MaxUploadSize {
+		return echo.NewHTTPError(http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("%s is too large: maximum upload size is %s", path.Base(p), bytes.Format(conf.MaxUploadSize)))
+	}
+
+	// Requests for the same file are written one after the other, the
+	// lock is held until the upload is renamed into place
+	defer lockName(conf.StoreDir, p)()
+
+	exists := func(n string) bool {
+		_, err := st.Stat(path.Join(path.Dir(p), n))
+		return err == nil
+	}
+
+	if conf.OnConflict == conflictReject && exists(path.Base(p)) {
+		return echo.NewHTTPError(http.StatusConflict, fmt.Sprintf("file already exists: %s", path.Base(p)))
+	}
+	if conf.OnConflict != conflictRename && exists(path.Base(p)) && isProtected(st, p) {
+		return protectedConflict(path.Base(p))
+	}
+
+	part := partName(conf.TmpDir, filename)
+
+	var received int64
+	fi, err := os.Stat(part)
+	if err == nil {
+		received = fi.Size()
+	}
+	if err := checkTotal(part, path.Base(p), total, err != nil); err != nil {
+		return err
+	}
+
+	if start > received {
+		c.Response().Header().Set(headerUploadOffset, strconv.FormatInt(received, 10))
+		return echo.NewHTTPError(http.StatusRequestedRangeNotSatisfiable,
+			fmt.Sprintf("range starts at %d but only %d bytes were received", start, received))
+	}
+
+	var grow int64
+	if end+1 > received {
+		grow = end + 1 - received
+	}
+	release, err := reserveQuota(conf, grow)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	f, err := os.OpenFile(part, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(start, io.SeekStart); err != nil {
+		return err
+	}
+
+	n, err := io.Copy(f, io.LimitReader(req.Body, end-start+1))
+	if err != nil {
+		return fmt.Errorf("could not store %s: %w", path.Base(p), err)
+	}
+	if n != end-start+1 {
+		return echo.NewHTTPError(http.StatusBadRequest, "request body is shorter than the content range")
+	}
+
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	if start+n > received {
+		received = start + n
+	}
+
+	c.Response().Header().Set(headerUploadOffset, strconv.FormatInt(received, 10))
+	if received < total {
+		return c.NoContent(http.StatusAccepted)
+	}
+
+	if err := f.Truncate(total); err != nil {
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := sniffPart(conf, part, path.Base(p)); err != nil {
+		removeTotal(part)
+		return err
+	}
+
+	if err := scanPart(conf, part, path.Base(p)); err != nil {
+		removeTotal(part)
+		return err
+	}
+
+	// The part is created with the umask applied
+	if err := os.Chmod(part, conf.FilePerm); err != nil {
+		return err
+	}
+
+	name := path.Base(p)
+	if conf.OnConflict == conflictRename {
+		name = renameOnConflict(name, exists)
+	}
+	dest := filepath.Join(filepath.Dir(filename), name)
+
+	if err := replaceFile(part, dest); err != nil {
+		return err
+	}
+	os.Remove(totalName(part))
+	uploadsTotal.Inc()
+	uploadBytesTotal.Add(float64(total))
+
+	p = path.Join(path.Dir(p), name)
+	if conf.indexDigests() {
+		sum, err := fileSHA256(st, p)
+		if err != nil {
+			return err
+		}
+		if err := dedupFile(conf.StoreDir, p, sum, conf.Dedup); err != nil {
+			return err
+		}
+	}
+	if err := deleteMeta(st, p); err != nil {
+		return err
+	}
+	if err := saveUploadMeta(c, conf, st, p, fileMeta{}, c.Param("name")); err != nil {
+		return err
+	}
+	if conf.TTL > 0 {
+		uploadTimes(conf.StoreDir).record(p, time.Now())
+	}
+	downloadCounts(conf.StoreDir).reset(p)
+	audit(c, conf, auditUpload, p, "", total)
+	runPostUpload(conf, p, c.Param("name"))
+
+	return c.JSON(http.StatusCreated, storedFile{
+		Name: name,
+		Path: p,
+		Size: total,
+		URL:  fileURL(conf.BasePath, p),
+	})
+}
+
+// scanPart scans a complete resumable upload with clamd, an infected file is
+// removed so that the upload has to start over
+func scanPart(conf config, part string, name string) error {
+	if conf.ClamAV == "" {
+		return nil
+	}
+
+	f, err := os.Open(part)
+	if err != nil {
+		return err
+	}
+	err = scanUpload(conf, name, f)
+	f.Close()
+
+	if he, ok := err.(*echo.HTTPError); ok && he.Code == http.StatusUnprocessableEntity {
+		os.Remove(part)
+	}
+
+	return err
+}
+
+// removeTotal removes the total size of a resumable upload once its partial
+// file was removed because it was refused
+func removeTotal(part string) {
+	if _, err := os.Stat(part); os.IsNotExist(err) {
+		os.Remove(totalName(part))
+	}
+}
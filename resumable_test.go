@@ -0,0 +1,121 @@
+// upl
+//
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// putRange sends a chunk of a resumable upload and returns the status
+func putRange(t *testing.T, url string, data string, contentRange string) int {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodPut, url, strings.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contentRange != "" {
+		req.Header.Set("Content-Range", contentRange)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	return res.StatusCode
+}
+
+func TestResumableTotalMismatch(t *testing.T) {
+	conf := testConfig(t)
+	ts := testServer(t, conf)
+
+	if code := putRange(t, ts.URL+"/files/f.txt", "hello", "bytes 0-4/10"); code != http.StatusAccepted {
+		t.Fatalf("first chunk: got status %d", code)
+	}
+
+	// The size of the file cannot change during the upload
+	for _, cr := range []string{"bytes 5-9/12", "bytes 5-7/8", "bytes 0-4/5"} {
+		if code := putRange(t, ts.URL+"/files/f.txt", "world", cr); code != http.StatusConflict {
+			t.Errorf("%s: got status %d", cr, code)
+		}
+	}
+
+	if code := putRange(t, ts.URL+"/files/f.txt", "world", "bytes 5-9/10"); code != http.StatusCreated {
+		t.Fatalf("last chunk: got status %d", code)
+	}
+	if got := readStoreFile(t, conf, "f.txt"); got != "helloworld" {
+		t.Errorf("got %q", got)
+	}
+
+	// Only the file is left once the upload is complete
+	if entries := storeEntries(t, conf); len(entries) != 1 || entries[0] != "f.txt" {
+		t.Errorf("got entries %v", entries)
+	}
+}
+
+func TestResumableDedup(t *testing.T) {
+	conf := testConfig(t)
+	conf.Dedup = true
+	ts := testServer(t, conf)
+
+	res := postFiles(t, ts.URL+"/", "upload", []testPart{{filename: "a.txt", data: "same contents"}}, nil)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusCreated {
+		t.Fatalf("upload: got status %d", res.StatusCode)
+	}
+
+	if code := putRange(t, ts.URL+"/files/b.txt", "same ", "bytes 0-4/13"); code != http.StatusAccepted {
+		t.Fatalf("first chunk: got status %d", code)
+	}
+	if code := putRange(t, ts.URL+"/files/b.txt", "contents", "bytes 5-12/13"); code != http.StatusCreated {
+		t.Fatalf("last chunk: got status %d", code)
+	}
+
+	a, err := os.Stat(filepath.Join(conf.StoreDir, "a.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.Stat(filepath.Join(conf.StoreDir, "b.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(a, b) {
+		t.Errorf("resumable upload not linked to the identical file")
+	}
+
+	// A unique file is recorded for the next uploads
+	if code := putRange(t, ts.URL+"/files/c.txt", "other contents", ""); code != http.StatusCreated {
+		t.Fatalf("whole file: got status %d", code)
+	}
+	if p, ok := dedupFiles(conf.StoreDir).lookup(conf.StoreDir, "425ecb5e1000c9545b105f1547c6d6f03d1cd4b38d94d457ec032907e8b51079"); !ok || p != "c.txt" {
+		t.Errorf("got %q, %v from the dedup index", p, ok)
+	}
+}
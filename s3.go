@@ -0,0 +1,215 @@
+// upl
+//
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// An s3Storage keeps files as objects of a bucket of an S3 compatible
+// service. Directories are emulated with slash separated object keys, the
+// objects of a store being under the name of the store with multiple stores.
+type s3Storage struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+// newS3Storage connects to the S3 endpoint of the configuration and checks
+// that the bucket exists
+func newS3Storage(conf config) (*s3Storage, error) {
+	client, err := minio.New(conf.S3Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(conf.S3AccessKey, conf.S3SecretKey, ""),
+		Secure: !conf.S3Insecure,
+		Region: conf.S3Region,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ok, err := client.BucketExists(context.Background(), conf.S3Bucket)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("no such bucket: %s", conf.S3Bucket)
+	}
+
+	s := &s3Storage{
+		client: client,
+		bucket: conf.S3Bucket,
+	}
+	if conf.StoreName != "" {
+		s.prefix = conf.StoreName + "/"
+	}
+
+	return s, nil
+}
+
+// key returns the object key of a file
+func (s *s3Storage) key(name string) string {
+	return s.prefix + strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// notExist gives the error reported for missing files, which os.IsNotExist
+// recognizes like with the local storage
+func notExist(op string, name string) error {
+	return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+}
+
+func (s *s3Storage) Put(name string, r io.Reader, size int64) error {
+	_, err := s.client.PutObject(context.Background(), s.bucket, s.key(name), r, size, minio.PutObjectOptions{})
+	return err
+}
+
+func (s *s3Storage) List(dir string) ([]fileEntry, error) {
+	prefix := s.key(dir)
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	if prefix == "/" {
+		prefix = ""
+	}
+
+	files := make([]fileEntry, 0)
+	for obj := range s.client.ListObjects(context.Background(), s.bucket, minio.ListObjectsOptions{Prefix: prefix}) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+
+		name := strings.TrimPrefix(obj.Key, prefix)
+		if name == "" {
+			// Marker of an empty directory
+			continue
+		}
+
+		// Common prefixes give the subdirectories
+		if strings.HasSuffix(name, "/") {
+			name = strings.TrimSuffix(name, "/")
+			files = append(files, fileEntry{
+				Name:  name,
+				Path:  path.Join(dir, name),
+				IsDir: true,
+			})
+			continue
+		}
+
+		files = append(files, fileEntry{
+			Name:    name,
+			Path:    path.Join(dir, name),
+			Size:    obj.Size,
+			ModTime: obj.LastModified,
+		})
+	}
+
+	return files, nil
+}
+
+func (s *s3Storage) Stat(name string) (fileEntry, error) {
+	key := s.key(name)
+	if key == s.prefix || key == "" {
+		return fileEntry{Path: "", IsDir: true}, nil
+	}
+
+	info, err := s.client.StatObject(context.Background(), s.bucket, key, minio.StatObjectOptions{})
+	if err == nil {
+		return fileEntry{
+			Name:    path.Base(name),
+			Path:    name,
+			Size:    info.Size,
+			ModTime: info.LastModified,
+		}, nil
+	}
+	if minio.ToErrorResponse(err).Code != "NoSuchKey" {
+		return fileEntry{}, err
+	}
+
+	// A directory exists when there are objects under its prefix
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: key + "/", MaxKeys: 1}) {
+		if obj.Err != nil {
+			return fileEntry{}, obj.Err
+		}
+		return fileEntry{Name: path.Base(name), Path: name, IsDir: true}, nil
+	}
+
+	return fileEntry{}, notExist("stat", name)
+}
+
+func (s *s3Storage) Open(name string) (io.ReadSeekCloser, error) {
+	obj, err := s.client.GetObject(context.Background(), s.bucket, s.key(name), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	// Errors are only known on the first access to the object
+	if _, err := obj.Stat(); err != nil {
+		obj.Close()
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, notExist("open", name)
+		}
+		return nil, err
+	}
+
+	return obj, nil
+}
+
+// Rename copies the object to its new key and removes the old one, S3 having
+// no rename operation
+func (s *s3Storage) Rename(oldName string, newName string) error {
+	if _, err := s.Stat(oldName); err != nil {
+		return err
+	}
+
+	dst := minio.CopyDestOptions{Bucket: s.bucket, Object: s.key(newName)}
+	src := minio.CopySrcOptions{Bucket: s.bucket, Object: s.key(oldName)}
+	if _, err := s.client.ComposeObject(context.Background(), dst, src); err != nil {
+		return err
+	}
+
+	return s.client.RemoveObject(context.Background(), s.bucket, s.key(oldName), minio.RemoveObjectOptions{})
+}
+
+// MkdirAll does nothing, directories only exist as prefixes of the keys of
+// the objects they contain
+func (s *s3Storage) MkdirAll(dir string) error {
+	return nil
+}
+
+func (s *s3Storage) Delete(name string) error {
+	if _, err := s.Stat(name); err != nil {
+		return err
+	}
+	return s.client.RemoveObject(context.Background(), s.bucket, s.key(name), minio.RemoveObjectOptions{})
+}
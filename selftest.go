@@ -0,0 +1,151 @@
+// upl
+//
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Name of the file uploaded by the self-test
+const selfTestFile = "upl-selftest.bin"
+
+// selfTest checks that a server with the default configuration works: it
+// serves a temporary store on an ephemeral port of the loopback interface,
+// uploads a file through the API, finds it in the listing and downloads it
+// back
+func selfTest() error {
+	dir, err := os.MkdirTemp("", "upl-selftest-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	conf := newConfig()
+	conf.StoreDir = dir
+
+	e, err := newServer(conf)
+	if err != nil {
+		return err
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Handler: e}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	base := "http://" + l.Addr().String()
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	data := make([]byte, 64*1024)
+	if _, err := rand.Read(data); err != nil {
+		return err
+	}
+
+	// Upload
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile(conf.UploadField, selfTestFile)
+	if err != nil {
+		return err
+	}
+	if _, err := fw.Write(data); err != nil {
+		return err
+	}
+	if err := mw.Close(); err != nil {
+		return err
+	}
+
+	res, err := client.Post(base+"/api/upload", mw.FormDataContentType(), &body)
+	if err != nil {
+		return fmt.Errorf("upload: %w", err)
+	}
+	var uploaded struct {
+		Files []storedFile `json:"files"`
+	}
+	if err := decodeSelfTestResponse(res, http.StatusCreated, &uploaded); err != nil {
+		return fmt.Errorf("upload: %w", err)
+	}
+	if len(uploaded.Files) != 1 || uploaded.Files[0].Name != selfTestFile {
+		return fmt.Errorf("upload: unexpected stored files: %v", uploaded.Files)
+	}
+
+	// Listing
+	res, err = client.Get(base + "/api/files")
+	if err != nil {
+		return fmt.Errorf("listing: %w", err)
+	}
+	var files []fileEntry
+	if err := decodeSelfTestResponse(res, http.StatusOK, &files); err != nil {
+		return fmt.Errorf("listing: %w", err)
+	}
+	if len(files) != 1 || files[0].Name != selfTestFile || files[0].Size != int64(len(data)) {
+		return fmt.Errorf("listing: unexpected entries: %v", files)
+	}
+
+	// Download
+	res, err = client.Get(base + uploaded.Files[0].URL)
+	if err != nil {
+		return fmt.Errorf("download: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("download: unexpected status %s", res.Status)
+	}
+	got, err := io.ReadAll(res.Body)
+	if err != nil {
+		return fmt.Errorf("download: %w", err)
+	}
+	if !bytes.Equal(got, data) {
+		return fmt.Errorf("download: contents differ from the uploaded file")
+	}
+
+	return nil
+}
+
+// decodeSelfTestResponse checks the status of res and decodes its JSON body
+// into v
+func decodeSelfTestResponse(res *http.Response, status int, v interface{}) error {
+	defer res.Body.Close()
+
+	if res.StatusCode != status {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("unexpected status %s: %s", res.Status, bytes.TrimSpace(msg))
+	}
+
+	return json.NewDecoder(res.Body).Decode(v)
+}
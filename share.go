@@ -0,0 +1,154 @@
+// upl
+//
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Validity of signed links when the share request gives no ttl
+const defaultShareTTL = 24 * time.Hour
+
+// signature computes the HMAC of the path of a file of a store and the
+// expiry time of a link, encoded to be used in a URL
+func signature(conf config, p string, exp string) string {
+	mac := hmac.New(sha256.New, []byte(conf.Secret))
+	mac.Write([]byte(conf.StoreName + "\x00" + p + "\x00" + exp))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// checkSignature verifies the signature and the expiry time of a link to the
+// file p
+func checkSignature(conf config, p string, exp string, sig string) error {
+	if !hmac.Equal([]byte(sig), []byte(signature(conf, p, exp))) {
+		return errors.New("invalid signature")
+	}
+
+	t, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil {
+		return errors.New("invalid expiry time")
+	}
+	if time.Now().Unix() > t {
+		return errors.New("link expired")
+	}
+
+	return nil
+}
+
+// isSignedRequest tells if a request is a download through a signed link,
+// which does not need credentials, the signature being checked when serving
+// the file
+func isSignedRequest(c echo.Context, conf config) bool {
+	if conf.Secret == "" || c.QueryParam("sig") == "" {
+		return false
+	}
+	// Downloads of password protected files are posted
+	if m := c.Request().Method; m != http.MethodGet && m != http.MethodPost {
+		return false
+	}
+	return strings.HasSuffix(c.Path(), "/files/*") || strings.HasSuffix(c.Path(), "/files/:name")
+}
+
+// shareFile returns a signed link to download a file without credentials
+// until the duration given by the ttl query parameter has elapsed
+func shareFile(c echo.Context, conf config) error {
+	st := storeStorage(conf)
+	rel, err := storageDir(st, c.QueryParam("path"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+
+	name, err := cleanFilename(c.Param("name"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+	if isReservedFile(name) {
+		return echo.NewHTTPError(http.StatusNotFound, "no such file: "+name)
+	}
+	p := path.Join(rel, name)
+
+	fe, err := st.Stat(p)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "no such file: "+name)
+	}
+
+	// The route shadows files named share at the first level of
+	// subdirectories, serve them as the download handler would
+	if fe.IsDir {
+		if rel != "" {
+			return echo.NewHTTPError(http.StatusNotFound, "no such file: "+name)
+		}
+		return serveStoreFile(c, conf, path.Join(p, "share"))
+	}
+
+	ttl, err := shareTTL(c)
+	if err != nil {
+		return err
+	}
+
+	return c.String(http.StatusOK, signedURL(c, conf, p, ttl)+"\n")
+}
+
+// shareTTL reads the validity of a signed link from the ttl query parameter
+func shareTTL(c echo.Context) (time.Duration, error) {
+	v := c.QueryParam("ttl")
+	if v == "" {
+		return defaultShareTTL, nil
+	}
+
+	ttl, err := time.ParseDuration(v)
+	if err != nil || ttl <= 0 {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, "invalid ttl: "+v)
+	}
+	return ttl, nil
+}
+
+// signedURL returns the absolute URL of a link to download the file p of the
+// store without credentials until ttl has elapsed
+func signedURL(c echo.Context, conf config, p string, ttl time.Duration) string {
+	exp := strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)
+	q := url.Values{}
+	q.Set("exp", exp)
+	q.Set("sig", signature(conf, p, exp))
+
+	return absoluteURL(c, fileURL(conf.BasePath, p)) + "?" + q.Encode()
+}
+
+// absoluteURL prefixes an escaped path with the scheme and host of the
+// request
+func absoluteURL(c echo.Context, u string) string {
+	return c.Scheme() + "://" + c.Request().Host + u
+}
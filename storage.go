@@ -0,0 +1,235 @@
+// upl
+//
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Backends where the files of the stores are kept
+const (
+	backendLocal = "local"
+	backendS3    = "s3"
+)
+
+// A storage holds the files of a store. Names are slash separated paths
+// relative to the root of the store, the empty name being the root.
+type storage interface {
+	// Put stores the contents of r under name, replacing any existing file.
+	// size is the length of the contents, -1 when unknown.
+	Put(name string, r io.Reader, size int64) error
+	// List returns the entries of the directory dir
+	List(dir string) ([]fileEntry, error)
+	// Stat returns the metadata of a file or directory
+	Stat(name string) (fileEntry, error)
+	// Open returns the contents of a file
+	Open(name string) (io.ReadSeekCloser, error)
+	// Delete removes a file
+	Delete(name string) error
+	// Rename moves a file to a new name, replacing any existing file
+	Rename(oldName string, newName string) error
+	// MkdirAll creates the directory dir and its missing parents
+	MkdirAll(dir string) error
+}
+
+// Storages of the stores by name, set up when the application starts
+var (
+	storagesMu sync.Mutex
+	storages   = make(map[string]storage)
+)
+
+// openStorages creates the storage of each store of the configuration
+func openStorages(conf config) error {
+	storagesMu.Lock()
+	defer storagesMu.Unlock()
+
+	for _, sc := range conf.storeConfigs() {
+		st, err := newStorage(sc)
+		if err != nil {
+			return fmt.Errorf("could not open store %s: %w", sc.StoreName, err)
+		}
+		storages[sc.StoreName] = st
+	}
+
+	return nil
+}
+
+// newStorage creates the storage of a store for the configured backend
+func newStorage(conf config) (storage, error) {
+	if conf.Backend == backendS3 {
+		return newS3Storage(conf)
+	}
+	return localStorage{dir: conf.StoreDir, perm: conf.StorePerm, filePerm: conf.FilePerm, noFollow: conf.NoFollowSymlinks, tmpDir: conf.TmpDir}, nil
+}
+
+// storeStorage returns the storage of the store of a handler, the store
+// directory on the local filesystem when none was opened
+func storeStorage(conf config) storage {
+	storagesMu.Lock()
+	defer storagesMu.Unlock()
+
+	if st, ok := storages[conf.StoreName]; ok {
+		return st
+	}
+	return localStorage{dir: conf.StoreDir, perm: conf.StorePerm, filePerm: conf.FilePerm, noFollow: conf.NoFollowSymlinks, tmpDir: conf.TmpDir}
+}
+
+// storageDir validates a slash separated path to a directory of a storage, it
+// returns the cleaned path, empty for the root
+func storageDir(st storage, p string) (string, error) {
+	rel, err := cleanRelPath(p)
+	if err != nil {
+		return "", err
+	}
+
+	fe, err := st.Stat(rel)
+	if err != nil && rel == "" {
+		return "", fmt.Errorf("%w: %v", errUnavailable, err)
+	}
+	if err != nil || !fe.IsDir {
+		return "", fmt.Errorf("no such directory: %s", p)
+	}
+
+	return rel, nil
+}
+
+// errUnavailable is returned when the contents of a store cannot be read, e.g.
+// when the network filesystem holding it is gone, which must not be taken for
+// an empty or missing directory
+var errUnavailable = errors.New("store unavailable")
+
+// unavailableError returns the 503 error of a request failing because the
+// store is unavailable
+func unavailableError(err error) *echo.HTTPError {
+	return &echo.HTTPError{
+		Code:     http.StatusServiceUnavailable,
+		Message:  "the store is unavailable, try again later",
+		Internal: err,
+	}
+}
+
+// cleanRelPath cleans a slash separated path relative to the root of a store,
+// paths going outside of the store are rejected
+func cleanRelPath(p string) (string, error) {
+	rel := path.Clean(strings.TrimLeft(p, "/"))
+	if rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("invalid path: %s", p)
+	}
+	if rel == "." {
+		rel = ""
+	}
+	return rel, nil
+}
+
+// A localStorage keeps files in a directory of the local filesystem
+type localStorage struct {
+	dir string
+	// Mode of the directories and files created in the store
+	perm     os.FileMode
+	filePerm os.FileMode
+	// Symbolic links are left out of listings and files cannot be read
+	// through them
+	noFollow bool
+	// Directory of the files being written, the directory of their
+	// destination when empty
+	tmpDir string
+}
+
+func (s localStorage) path(name string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(path.Clean("/"+name)))
+}
+
+// check returns an error when filename cannot be read because it goes
+// through a symbolic link that is not followed
+func (s localStorage) check(filename string) error {
+	if !s.noFollow {
+		return nil
+	}
+	return checkNoSymlink(s.dir, filename)
+}
+
+func (s localStorage) Put(name string, r io.Reader, size int64) error {
+	return writeFile(s.path(name), s.tmpDir, s.filePerm, r)
+}
+
+func (s localStorage) List(dir string) ([]fileEntry, error) {
+	filename := s.path(dir)
+	if _, err := os.Stat(filename); err != nil {
+		return nil, err
+	}
+	if err := s.check(filename); err != nil {
+		return nil, err
+	}
+	return listCurrentDir(filename, dir, s.noFollow)
+}
+
+func (s localStorage) Stat(name string) (fileEntry, error) {
+	filename := s.path(name)
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return fileEntry{}, err
+	}
+	if err := s.check(filename); err != nil {
+		return fileEntry{}, err
+	}
+
+	return fileEntry{
+		Name:    fi.Name(),
+		Path:    name,
+		IsDir:   fi.IsDir(),
+		Size:    fi.Size(),
+		ModTime: fi.ModTime(),
+	}, nil
+}
+
+func (s localStorage) Open(name string) (io.ReadSeekCloser, error) {
+	filename := s.path(name)
+	if err := s.check(filename); err != nil {
+		return nil, err
+	}
+	return os.Open(filename)
+}
+
+func (s localStorage) Delete(name string) error {
+	return os.Remove(s.path(name))
+}
+
+func (s localStorage) Rename(oldName string, newName string) error {
+	return os.Rename(s.path(oldName), s.path(newName))
+}
+
+func (s localStorage) MkdirAll(dir string) error {
+	return os.MkdirAll(s.path(dir), s.perm)
+}
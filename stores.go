@@ -0,0 +1,177 @@
+// upl
+//
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"html/template"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Store names are used as the first element of the path of the routes of the
+// store, they cannot be the same as the other routes at the root
+var (
+	storeNameRe        = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+	reservedStoreNames = map[string]bool{
+		"static":  true,
+		"metrics": true,
+		"version": true,
+		"api":     true,
+	}
+)
+
+// A storeFlag collects the values of the repeatable -store option, either a
+// single directory or name=dir pairs
+type storeFlag struct {
+	values []string
+	set    bool
+}
+
+func (f *storeFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return strings.Join(f.values, ",")
+}
+
+// Set adds a store, the first call replaces the default
+func (f *storeFlag) Set(v string) error {
+	if !f.set {
+		f.values = nil
+		f.set = true
+	}
+	f.values = append(f.values, v)
+	return nil
+}
+
+// Reset forgets the values set so far, when a layer of the configuration
+// overrides a previous one
+func (f *storeFlag) Reset() {
+	f.set = false
+}
+
+// apply sets the stores in the configuration. A single value without a name
+// keeps the behaviour of a single store, otherwise all stores must be named.
+func (f *storeFlag) apply(c *config) error {
+	if len(f.values) == 1 {
+		if _, _, ok := splitStore(f.values[0]); !ok {
+			c.StoreDir = f.values[0]
+			return nil
+		}
+	}
+
+	c.Stores = make(map[string]string, len(f.values))
+	for _, v := range f.values {
+		name, dir, ok := splitStore(v)
+		if !ok {
+			return fmt.Errorf("%s: multiple stores must be given as name=dir", v)
+		}
+		if reservedStoreNames[name] {
+			return fmt.Errorf("%s: reserved store name", name)
+		}
+		if _, dup := c.Stores[name]; dup {
+			return fmt.Errorf("%s: duplicate store name", name)
+		}
+		c.Stores[name] = dir
+	}
+	c.StoreDir = ""
+
+	return nil
+}
+
+// splitStore parses a name=dir store, the name must be a valid path element
+func splitStore(v string) (string, string, bool) {
+	name, dir, ok := cut(v, "=")
+	if !ok || dir == "" || !storeNameRe.MatchString(name) {
+		return "", "", false
+	}
+	return name, dir, true
+}
+
+// storeConfigs returns the configuration of each store, sorted by name, to be
+// passed to the handlers of the store
+func (c config) storeConfigs() []config {
+	if len(c.Stores) == 0 {
+		if c.Dashboard {
+			c.BasePath += "/" + dashboardStorePath
+		}
+		return []config{c}
+	}
+
+	names := make([]string, 0, len(c.Stores))
+	for name := range c.Stores {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	confs := make([]config, 0, len(names))
+	for _, name := range names {
+		sc := c
+		sc.StoreName = name
+		sc.StoreDir = c.Stores[name]
+		sc.BasePath = c.BasePath + "/" + name
+		confs = append(confs, sc)
+	}
+
+	return confs
+}
+
+func listStores(c echo.Context, conf config) error {
+
+	type storeLink struct {
+		Name string `json:"name"`
+		URL  string `json:"url"`
+	}
+
+	stores := make([]storeLink, 0, len(conf.Stores))
+	for _, sc := range conf.storeConfigs() {
+		stores = append(stores, storeLink{Name: sc.StoreName, URL: sc.BasePath + "/"})
+	}
+
+	if wantsJSON(c) {
+		return c.JSON(http.StatusOK, stores)
+	}
+
+	v := struct {
+		Root     string
+		BasePath string
+		Title    string
+		Footer   template.HTML
+		Stores   []storeLink
+	}{
+		Root:     conf.RootPath,
+		BasePath: conf.BasePath,
+		Title:    conf.Title,
+		Footer:   template.HTML(conf.Footer),
+		Stores:   stores,
+	}
+
+	return c.Render(http.StatusOK, "stores.html", v)
+}
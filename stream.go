@@ -0,0 +1,308 @@
+// upl
+//
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/bytes"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Maximum size of the value of a field of a streamed multipart form
+const maxFieldSize = 64 << 10
+
+// A countingReader counts the bytes read from r
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// A limitedReader fails with the 413 status once more than max bytes are
+// read
+type limitedReader struct {
+	r    io.Reader
+	n    int64
+	max  int64
+	name string
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if left := l.max - l.n + 1; int64(len(p)) > left {
+		p = p[:left]
+	}
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+	if l.n > l.max {
+		return n, echo.NewHTTPError(http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("%s is too large: maximum upload size is %s", l.name, bytes.Format(l.max)))
+	}
+	return n, err
+}
+
+// streamUploads stores the files of a multipart form
+// while its parts are read from the request, without the intermediate copy
+// of c.MultipartForm to memory or temporary files. The path and password
+// fields must come before the files in the form to apply to them. Files are
+// checked one at a time, those stored before an invalid one are kept.
+func streamUploads(c echo.Context, conf config) ([]storedFile, error) {
+
+	start := time.Now()
+	defer func() { uploadDuration.Observe(time.Since(start).Seconds()) }()
+
+	mr, err := c.Request().MultipartReader()
+	if err != nil {
+		return nil, multipartError(err)
+	}
+
+	// The size of the files is only known once stored, the size of the
+	// request is the closest estimate. Without it, the quota is checked
+	// after each file is stored.
+	sized := c.Request().ContentLength > 0
+	var reserve int64
+	if sized {
+		reserve = c.Request().ContentLength
+	}
+	release, err := reserveQuota(conf, reserve)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	st := storeStorage(conf)
+	fields := make(map[string]string)
+	var (
+		rel      string
+		meta     fileMeta
+		prepared bool
+	)
+
+	stored := make([]storedFile, 0)
+	rejected := make([]string, 0)
+	count := 0
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, multipartError(err)
+		}
+
+		// Parts without filename are fields, the files of any field
+		// are accepted because the whole form is not known yet
+		filename := decodeFilename(part.FileName(), part.Header)
+		if filename == "" {
+			v, err := io.ReadAll(io.LimitReader(part, maxFieldSize))
+			if err != nil {
+				return nil, multipartError(err)
+			}
+			fields[part.FormName()] = string(v)
+			part.Close()
+			continue
+		}
+
+		// The fields read so far apply to all the files
+		if !prepared {
+			rel, err = storageDir(st, fields["path"])
+			if err != nil {
+				return nil, echo.NewHTTPError(http.StatusNotFound, err.Error())
+			}
+
+			meta, err = passwordMeta(fields[passwordField])
+			if err != nil {
+				return nil, err
+			}
+
+			rel, err = uploadDir(conf, st, rel, time.Now())
+			if err != nil {
+				return nil, err
+			}
+			prepared = true
+		}
+
+		count++
+		if conf.MaxFiles > 0 && count > conf.MaxFiles {
+			return nil, echo.NewHTTPError(http.StatusBadRequest,
+				fmt.Sprintf("too many files: maximum is %d per upload", conf.MaxFiles))
+		}
+
+		// The digest given in the header of the request applies to the
+		// first file, the whole form is not known yet
+		want, err := expectedChecksum(c.Request().Header, part.Header, count == 1)
+		if err != nil {
+			return nil, err
+		}
+		sf, ok, err := streamFile(conf, st, rel, part, filename, want)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			rejected = append(rejected, filename)
+			continue
+		}
+		if !sized {
+			if err := checkStoredQuota(conf, st, sf.Path); err != nil {
+				return nil, err
+			}
+		}
+
+		if err := saveUploadMeta(c, conf, st, sf.Path, meta, filename); err != nil {
+			return nil, fmt.Errorf("could not save the metadata of %s: %w", sf.Name, err)
+		}
+		stored = append(stored, sf)
+		audit(c, conf, auditUpload, sf.Path, "", sf.Size)
+		runPostUpload(conf, sf.Path, filename)
+	}
+
+	if count == 0 {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "no file in the form")
+	}
+
+	if len(rejected) > 0 {
+		return nil, echo.NewHTTPError(http.StatusConflict,
+			fmt.Sprintf("files already exist: %s", strings.Join(rejected, ", ")))
+	}
+
+	return stored, nil
+}
+
+// streamFile checks and stores the contents of src, the file of a part of a
+// multipart form or a fetched URL, under its decoded filename. With ClamAV or
+// the digest expected by the client in want, the file is first written to a
+// temporary file, checked and scanned, it is only stored when clean, so that
+// a corrupted or infected file never replaces a file of the store nor can be
+// downloaded.
+func streamFile(conf config, st storage, rel string, src io.Reader, filename string, want string) (storedFile, bool, error) {
+	name, err := sanitizeFilename(filename, conf)
+	if err != nil {
+		return storedFile{}, false, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	if err := checkExtension(name, conf); err != nil {
+		return storedFile{}, false, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	if conf.MaxUploadSize > 0 {
+		src = &limitedReader{r: src, max: conf.MaxUploadSize, name: filename}
+	}
+
+	// The type is detected from the first bytes of the file, read before
+	// storing it
+	src, err = sniffStream(conf, name, src)
+	if err != nil {
+		var he *echo.HTTPError
+		if errors.As(err, &he) {
+			return storedFile{}, false, he
+		}
+		return storedFile{}, false, fmt.Errorf("could not read %s: %w", filename, err)
+	}
+
+	if conf.ClamAV != "" || want != "" {
+		var cr *checksumReader
+		if want != "" {
+			cr = newChecksumReader(src, want, filename)
+			src = cr
+		}
+
+		tmp, err := spoolFile(conf, src)
+		if err != nil {
+			return storedFile{}, false, storeError(filename, err)
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+
+		if cr != nil {
+			if err := cr.check(); err != nil {
+				return storedFile{}, false, err
+			}
+		}
+		if conf.ClamAV != "" {
+			if err := scanUpload(conf, name, tmp); err != nil {
+				return storedFile{}, false, err
+			}
+			if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+				return storedFile{}, false, err
+			}
+		}
+		src = tmp
+	}
+
+	sf, ok, err := storeFile(conf, st, rel, name, src, -1)
+	if err != nil {
+		return storedFile{}, false, storeError(filename, err)
+	}
+
+	return sf, ok, nil
+}
+
+// storeError returns the error of storing a streamed file, the errors with a
+// status, like the body limit reached while reading the part, are kept as is
+func storeError(filename string, err error) error {
+	var he *echo.HTTPError
+	if errors.As(err, &he) {
+		return he
+	}
+	return fmt.Errorf("could not store %s: %w", filename, err)
+}
+
+// spoolFile copies the contents of src to a temporary file, hidden in
+// TmpDir or at the root of the store directory, open and positioned at its
+// start. The caller closes and removes it.
+func spoolFile(conf config, src io.Reader) (*os.File, error) {
+	dir := conf.TmpDir
+	if dir == "" {
+		dir = conf.StoreDir
+	}
+
+	f, err := os.CreateTemp(dir, ".upl-*.part")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(f, src); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+
+	return f, nil
+}
@@ -0,0 +1,122 @@
+// upl
+//
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestStreamUploads(t *testing.T) {
+	conf := testConfig(t)
+	conf.StreamUploads = true
+	ts := testServer(t, conf)
+
+	// Files larger than the memory of multipart forms are stored as is
+	large := strings.Repeat("0123456789abcdef", 1<<17)
+	parts := []testPart{
+		{filename: "small.txt", data: "small"},
+		{filename: "large.bin", data: large},
+		{filename: "empty.txt", data: ""},
+	}
+	res := postFiles(t, ts.URL+"/api/upload", conf.UploadField, parts, nil)
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("got status %d", res.StatusCode)
+	}
+
+	for _, p := range parts {
+		if got := readStoreFile(t, conf, p.filename); got != p.data {
+			t.Errorf("%s: got %d bytes, want %d", p.filename, len(got), len(p.data))
+		}
+	}
+	if names := storeEntries(t, conf); len(names) != len(parts) {
+		t.Errorf("got entries %v", names)
+	}
+}
+
+// benchmarkUpload posts a form with a file of size bytes to the upload API
+func benchmarkUpload(b *testing.B, stream bool, size int) {
+	conf := newConfig()
+	conf.StoreDir = b.TempDir()
+	conf.CSRF = false
+	conf.NoAccessLog = true
+	conf.StreamUploads = stream
+	conf.MultipartMem = 1 << 20
+
+	e, err := newServer(conf)
+	if err != nil {
+		b.Fatal(err)
+	}
+	ts := httptest.NewServer(e)
+	defer ts.Close()
+	defer func() {
+		storagesMu.Lock()
+		delete(storages, conf.StoreName)
+		storagesMu.Unlock()
+	}()
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	w, err := mw.CreateFormFile(conf.UploadField, "bench.bin")
+	if err != nil {
+		b.Fatal(err)
+	}
+	w.Write(bytes.Repeat([]byte{'x'}, size))
+	mw.Close()
+	data := body.Bytes()
+
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		res, err := http.Post(ts.URL+"/api/upload", mw.FormDataContentType(), bytes.NewReader(data))
+		if err != nil {
+			b.Fatal(err)
+		}
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+		if res.StatusCode != http.StatusCreated {
+			b.Fatalf("got status %d", res.StatusCode)
+		}
+	}
+}
+
+func BenchmarkUpload(b *testing.B) {
+	for _, size := range []int{64 << 10, 16 << 20} {
+		for _, stream := range []bool{false, true} {
+			name := fmt.Sprintf("size=%dKiB/buffered", size>>10)
+			if stream {
+				name = fmt.Sprintf("size=%dKiB/stream", size>>10)
+			}
+			b.Run(name, func(b *testing.B) { benchmarkUpload(b, stream, size) })
+		}
+	}
+}
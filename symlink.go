@@ -0,0 +1,74 @@
+// upl
+//
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"path/filepath"
+)
+
+// errSymlink is returned for paths of a store going through a symbolic link
+// when they are not followed
+var errSymlink = errors.New("symbolic links are not followed")
+
+// checkNoSymlink tells if filename, a path inside the directory storeDir,
+// can be accessed without following a symbolic link below storeDir. The
+// store directory itself may be a link. A link would let clients reach files
+// outside of the store, when it points elsewhere on the filesystem.
+func checkNoSymlink(storeDir string, filename string) error {
+	storeDir, err := filepath.Abs(storeDir)
+	if err != nil {
+		return err
+	}
+	filename, err = filepath.Abs(filename)
+	if err != nil {
+		return err
+	}
+
+	root, err := filepath.EvalSymlinks(storeDir)
+	if err != nil {
+		return err
+	}
+
+	rel, err := filepath.Rel(storeDir, filename)
+	if err != nil {
+		return err
+	}
+
+	resolved, err := filepath.EvalSymlinks(filename)
+	if err != nil {
+		return err
+	}
+
+	// The resolved path stays inside the store only when it is the path
+	// given, there is no link on the way otherwise
+	if resolved != filepath.Join(root, rel) {
+		return &fs.PathError{Op: "open", Path: filename, Err: errSymlink}
+	}
+
+	return nil
+}
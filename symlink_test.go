@@ -0,0 +1,170 @@
+// upl
+//
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// symlinkStore creates a store with links escaping it to a secret file and
+// to the directory holding it, a link inside the store and a regular file. It
+// returns the path of the store directory.
+func symlinkStore(t *testing.T) string {
+	t.Helper()
+
+	outside := t.TempDir()
+	if err := os.WriteFile(filepath.Join(outside, "secret.txt"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The store directory is reached through a link, which is allowed
+	base := t.TempDir()
+	dir := filepath.Join(base, "real")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	store := filepath.Join(base, "store")
+	if err := os.Symlink(dir, store); err != nil {
+		t.Skip("cannot create symbolic links:", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(store, "public.txt"), []byte("public"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for link, target := range map[string]string{
+		"link.txt":  filepath.Join(outside, "secret.txt"),
+		"linkdir":   outside,
+		"inner.txt": "public.txt",
+	} {
+		if err := os.Symlink(target, filepath.Join(store, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return store
+}
+
+func TestCheckNoSymlink(t *testing.T) {
+	store := symlinkStore(t)
+
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"public.txt", true},
+		{".", true},
+		{"link.txt", false},
+		{"linkdir", false},
+		{"linkdir/secret.txt", false},
+		{"inner.txt", false},
+	}
+
+	for _, tt := range tests {
+		err := checkNoSymlink(store, filepath.Join(store, filepath.FromSlash(tt.name)))
+		if (err == nil) != tt.ok {
+			t.Errorf("checkNoSymlink(%s): got error %v", tt.name, err)
+		}
+		if err != nil && !tt.ok && !errors.Is(err, errSymlink) {
+			t.Errorf("checkNoSymlink(%s): got error %v, want %v", tt.name, err, errSymlink)
+		}
+	}
+
+	if err := checkNoSymlink(store, filepath.Join(store, "missing.txt")); err == nil {
+		t.Errorf("checkNoSymlink of a missing file succeeded")
+	}
+}
+
+func TestNoFollowSymlinks(t *testing.T) {
+	conf := testConfig(t)
+	conf.StoreDir = symlinkStore(t)
+	conf.NoFollowSymlinks = true
+	ts := testServer(t, conf)
+
+	get := func(p string) (int, string) {
+		res, err := http.Get(ts.URL + p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, _ := io.ReadAll(res.Body)
+		return res.StatusCode, string(body)
+	}
+
+	if code, body := get("/files/public.txt"); code != http.StatusOK || body != "public" {
+		t.Errorf("public.txt: got %d %q", code, body)
+	}
+
+	// The index page of a directory is a link to the secret
+	site := filepath.Join(conf.StoreDir, "site")
+	if err := os.Mkdir(site, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(conf.StoreDir, "link.txt"), filepath.Join(site, "index.html")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []string{"/files/link.txt", "/files/linkdir/secret.txt", "/files/inner.txt", "/api/files?path=linkdir", "/files/site/"} {
+		if code, body := get(p); code != http.StatusNotFound || body == "secret" {
+			t.Errorf("%s: got %d %q", p, code, body)
+		}
+	}
+
+	res, err := http.Get(ts.URL + "/api/files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var files []fileEntry
+	if err := json.NewDecoder(res.Body).Decode(&files); err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || files[0].Name != "public.txt" || files[1].Name != "site" {
+		t.Errorf("got listing %+v", files)
+	}
+}
+
+func TestFollowSymlinks(t *testing.T) {
+	conf := testConfig(t)
+	conf.StoreDir = symlinkStore(t)
+	ts := testServer(t, conf)
+
+	// Links are followed by default, which is the documented risk
+	res, err := http.Get(ts.URL + "/files/link.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK || string(body) != "secret" {
+		t.Errorf("got %d %q", res.StatusCode, body)
+	}
+}
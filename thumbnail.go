@@ -0,0 +1,210 @@
+// upl
+//
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/image/draw"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Bounds of the width of thumbnails and width used when not given
+const (
+	thumbMinWidth     = 16
+	thumbMaxWidth     = 2048
+	thumbDefaultWidth = 200
+)
+
+// Images with more pixels are not decoded to make thumbnails
+const thumbMaxPixels = 100 * 1000 * 1000
+
+// Extensions of the images thumbnails are made of
+var thumbExts = map[string]struct{}{
+	".gif":  {},
+	".jpeg": {},
+	".jpg":  {},
+	".png":  {},
+}
+
+// HasThumbnail tells if the entry is an image a thumbnail can be made of,
+// protected images have none
+func (f fileEntry) HasThumbnail() bool {
+	_, ok := thumbExts[strings.ToLower(path.Ext(f.Name))]
+	return ok && !f.IsDir && !f.Protected
+}
+
+// defaultThumbDir returns the user cache directory for thumbnails, or a
+// directory in the temporary directory when there is no cache directory
+func defaultThumbDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "upl", "thumbnails")
+}
+
+// thumbCacheName returns the name of the cached thumbnail of a file, which
+// changes with the size and modification time of the file
+func thumbCacheName(cacheDir string, filename string, fe fileEntry, width int, format string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%d\x00%d\x00%d", filename, fe.Size, fe.ModTime.UnixNano(), width)
+	return filepath.Join(cacheDir, hex.EncodeToString(h.Sum(nil))+"."+format)
+}
+
+func thumbnail(c echo.Context, conf config) error {
+
+	st := storeStorage(conf)
+	rel, err := storageDir(st, c.QueryParam("path"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+
+	name, err := cleanFilename(c.Param("name"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+	if isReservedFile(name) {
+		return echo.NewHTTPError(http.StatusNotFound, "no such file: "+name)
+	}
+	p := path.Join(rel, name)
+
+	// A thumbnail would reveal the contents of a protected image
+	if m, err := loadMeta(st, p); err != nil || m.PasswordHash != "" {
+		return echo.NewHTTPError(http.StatusForbidden, "this file is protected by a password")
+	}
+
+	width := thumbDefaultWidth
+	if w := c.QueryParam("w"); w != "" {
+		width, err = strconv.Atoi(w)
+		if err != nil || width < thumbMinWidth || width > thumbMaxWidth {
+			return echo.NewHTTPError(http.StatusBadRequest,
+				fmt.Sprintf("width must be between %d and %d", thumbMinWidth, thumbMaxWidth))
+		}
+	}
+
+	fe, err := st.Stat(p)
+	if err != nil || fe.IsDir {
+		return echo.NewHTTPError(http.StatusNotFound, "no such file: "+name)
+	}
+
+	f, err := st.Open(p)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "no such file: "+name)
+	}
+	defer f.Close()
+
+	cfg, format, err := image.DecodeConfig(f)
+	if err != nil || cfg.Width*cfg.Height > thumbMaxPixels {
+		return echo.NewHTTPError(http.StatusNotFound, "not an image: "+name)
+	}
+
+	// Keep the format for JPEG, use PNG for the others to keep transparency
+	if format != "jpeg" {
+		format = "png"
+	}
+
+	// The name of the cached thumbnail identifies the source file and the
+	// width, it gives the ETag
+	filename, err := filepath.Abs(filepath.Join(conf.StoreDir, filepath.FromSlash(p)))
+	if err != nil {
+		return err
+	}
+	cached := thumbCacheName(conf.ThumbDir, filename, fe, width, format)
+	c.Response().Header().Set("ETag", `"`+strings.TrimSuffix(filepath.Base(cached), filepath.Ext(cached))+`"`)
+	if _, err := os.Stat(cached); err == nil {
+		return c.File(cached)
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	src, _, err := image.Decode(f)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "not an image: "+name)
+	}
+
+	if err := os.MkdirAll(conf.ThumbDir, 0755); err != nil {
+		return err
+	}
+
+	if err := writeThumbnail(cached, scaleImage(src, width), format); err != nil {
+		return err
+	}
+
+	return c.File(cached)
+}
+
+// scaleImage resizes an image to the given width keeping its aspect ratio.
+// Images are never enlarged.
+func scaleImage(src image.Image, width int) image.Image {
+	b := src.Bounds()
+	if b.Dx() <= width {
+		return src
+	}
+
+	height := b.Dy() * width / b.Dx()
+	if height < 1 {
+		height = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, b, draw.Over, nil)
+
+	return dst
+}
+
+// writeThumbnail encodes an image to a file of the cache. As the cache is
+// shared by requests, the file is written atomically.
+func writeThumbnail(filename string, img image.Image, format string) error {
+	pr, pw := io.Pipe()
+	go func() {
+		var err error
+		if format == "jpeg" {
+			err = jpeg.Encode(pw, img, &jpeg.Options{Quality: 85})
+		} else {
+			err = png.Encode(pw, img)
+		}
+		pw.CloseWithError(err)
+	}()
+
+	err := writeFile(filename, "", 0644, pr)
+	pr.Close()
+	return err
+}
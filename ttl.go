@@ -0,0 +1,248 @@
+// upl
+//
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Name of the file, at the root of the store, where upload times are saved
+const uploadIndexFile = ".upl-uploads.json"
+
+// How often expired files are looked for
+const expiryInterval = time.Minute
+
+// An uploadIndex records when files were uploaded, by path relative to the
+// store directory, to compute when they expire
+type uploadIndex struct {
+	mu    sync.Mutex
+	file  string
+	times map[string]time.Time
+	dirty bool
+}
+
+// Upload indexes by store directory
+var (
+	uploadIndexesMu sync.Mutex
+	uploadIndexes   = make(map[string]*uploadIndex)
+)
+
+// uploadTimes returns the upload index of a store, loaded from the index file
+// of the store on first use
+func uploadTimes(storeDir string) *uploadIndex {
+	uploadIndexesMu.Lock()
+	defer uploadIndexesMu.Unlock()
+
+	ui, ok := uploadIndexes[storeDir]
+	if !ok {
+		ui = &uploadIndex{
+			file:  filepath.Join(storeDir, uploadIndexFile),
+			times: make(map[string]time.Time),
+		}
+		uploadIndexes[storeDir] = ui
+	}
+
+	return ui
+}
+
+// load reads the index from its file, a missing file gives an empty index
+func (ui *uploadIndex) load() error {
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+
+	data, err := os.ReadFile(ui.file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	return json.Unmarshal(data, &ui.times)
+}
+
+// save writes the index to its file when it has changed
+func (ui *uploadIndex) save() error {
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+
+	if !ui.dirty || ui.file == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(ui.times)
+	if err != nil {
+		return err
+	}
+
+	tmp := ui.file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, ui.file); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	ui.dirty = false
+	return nil
+}
+
+func (ui *uploadIndex) record(rel string, t time.Time) {
+	ui.mu.Lock()
+	ui.times[rel] = t
+	ui.dirty = true
+	ui.mu.Unlock()
+}
+
+func (ui *uploadIndex) forget(rel string) {
+	ui.mu.Lock()
+	if _, ok := ui.times[rel]; ok {
+		delete(ui.times, rel)
+		ui.dirty = true
+	}
+	ui.mu.Unlock()
+}
+
+// move keeps the upload time of a renamed file
+func (ui *uploadIndex) move(from string, to string) {
+	ui.mu.Lock()
+	if t, ok := ui.times[from]; ok {
+		delete(ui.times, from)
+		ui.times[to] = t
+		ui.dirty = true
+	}
+	ui.mu.Unlock()
+}
+
+// uploadedAt returns the upload time of a file, or its modification time when
+// it was not recorded, e.g. the file was already in the store at startup
+func (ui *uploadIndex) uploadedAt(rel string, modTime time.Time) time.Time {
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+
+	if t, ok := ui.times[rel]; ok {
+		return t
+	}
+	return modTime
+}
+
+// addExpiry sets the expiration time of the regular files of a listing
+func addExpiry(files []fileEntry, conf config) {
+	ui := uploadTimes(conf.StoreDir)
+	for i := range files {
+		if files[i].IsDir || files[i].ModTime.IsZero() {
+			continue
+		}
+
+		exp := ui.uploadedAt(files[i].Path, files[i].ModTime).Add(conf.TTL)
+		files[i].Expires = &exp
+	}
+}
+
+// expireFiles periodically removes the files of the store older than the TTL
+// until the context is done
+func expireFiles(ctx context.Context, conf config) {
+	ticker := time.NewTicker(expiryInterval)
+	defer ticker.Stop()
+
+	for {
+		removeExpired(conf.StoreDir, conf.TTL)
+		storeUsage(conf).invalidate()
+		if err := uploadTimes(conf.StoreDir).save(); err != nil {
+			log.Println("could not save upload times:", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// removeExpired walks the store and removes the files uploaded more than ttl
+// ago
+func removeExpired(storeDir string, ttl time.Duration) {
+	now := time.Now()
+	ui := uploadTimes(storeDir)
+
+	filepath.WalkDir(storeDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			log.Println("could not look for expired files:", err)
+			return nil
+		}
+
+		// The indexes, description and partial uploads of upl are kept,
+		// sidecars are removed along with their file
+		if !d.Type().IsRegular() || isReservedFile(d.Name()) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+
+		rel, err := filepath.Rel(storeDir, p)
+		if err != nil {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+
+		if now.Before(ui.uploadedAt(rel, info.ModTime()).Add(ttl)) {
+			return nil
+		}
+
+		if err := removeStoreFile(storeDir, rel); err != nil {
+			log.Println("could not remove expired file:", err)
+			return nil
+		}
+		log.Println("removed expired file:", rel)
+
+		return nil
+	})
+}
+
+// removeStoreFile removes the file rel of the store along with its sidecar,
+// upload time and download count
+func removeStoreFile(storeDir string, rel string) error {
+	if err := os.Remove(filepath.Join(storeDir, filepath.FromSlash(rel))); err != nil {
+		return err
+	}
+	os.Remove(filepath.Join(storeDir, filepath.FromSlash(metaPath(rel))))
+	uploadTimes(storeDir).forget(rel)
+	downloadCounts(storeDir).reset(rel)
+
+	return nil
+}
@@ -0,0 +1,79 @@
+// upl
+//
+// Copyright 2021 Nicolas Thauvin. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRemoveExpiredKeepsInternalFiles(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// Everything is older than the TTL but the fresh file
+	old := time.Now().Add(-2 * time.Hour)
+	expired := []string{"a.txt", ".a.txt.upl.json", "sub/b.txt", ".dotfile"}
+	kept := []string{
+		"fresh.txt",
+		".upl-description",
+		"sub/.upl-description",
+		".upl-downloads.json",
+		".upl-dedup.json.tmp",
+		".upl-1234.part",
+		".video.mp4.part",
+		"sub/.c.txt.part",
+	}
+	for _, name := range append(append([]string{}, expired...), kept...) {
+		filename := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.WriteFile(filename, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if name == "fresh.txt" {
+			continue
+		}
+		if err := os.Chtimes(filename, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	removeExpired(dir, time.Hour)
+
+	for _, name := range expired {
+		if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(name))); err == nil {
+			t.Errorf("%s not removed", name)
+		}
+	}
+	for _, name := range kept {
+		if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(name))); err != nil {
+			t.Errorf("%s removed: %v", name, err)
+		}
+	}
+}